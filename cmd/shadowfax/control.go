@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/server"
+)
+
+const (
+	rollbackPath = "/__shadowfax/rollback"
+	statsPath    = "/__shadowfax/stats"
+)
+
+type rollbacker interface {
+	Rollback() (server.Build, error)
+}
+
+// rollbackHandler serves POST /__shadowfax/rollback.
+func rollbackHandler(app rollbacker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		build, err := app.Rollback()
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, server.ErrNoPreviousBuild) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(build)
+	})
+}
+
+// runRollbackCommand implements `shadowfax rollback` by asking the running
+// instance to restart its previous good build.
+func runRollbackCommand(proxyPort string) error {
+	client, baseURL, err := controlClient(proxyPort)
+	if err != nil {
+		return err
+	}
+	url := baseURL + rollbackPath
+
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("contacting shadowfax on port %s: %w", proxyPort, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("rollback rejected: %s", strings.TrimSpace(string(body)))
+	}
+
+	var build server.Build
+	if err := json.Unmarshal(body, &build); err != nil {
+		return fmt.Errorf("decoding rollback response: %w", err)
+	}
+	fmt.Printf("Rolling back to build %s (built %s)\n", build.ID, build.BuiltAt.Format(time.DateTime))
+	return nil
+}
+
+// watchKeyboard reads commands typed into the terminal running shadowfax.
+func watchKeyboard(ctx context.Context, in io.Reader, app rollbacker) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return
+		}
+		switch strings.TrimSpace(scanner.Text()) {
+		case "b", "rollback":
+			if _, err := app.Rollback(); err != nil {
+				fmt.Printf("[shadowfax] Rollback unavailable: %v\n", err)
+			}
+		}
+	}
+}
+
+func keepBuildsFromEnv() int {
+	raw := os.Getenv("SHADOWFAX_KEEP_BUILDS")
+	if raw == "" {
+		return server.DefaultKeepBuilds
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		fmt.Fprintf(os.Stderr, "Warning: invalid SHADOWFAX_KEEP_BUILDS %q, using %d\n", raw, server.DefaultKeepBuilds)
+		return server.DefaultKeepBuilds
+	}
+	return n
+}
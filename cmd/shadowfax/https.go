@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/certs"
+	"github.com/mbvlabs/shadowfax/internal/config"
+)
+
+// loadCA loads the shared local CA, creating it on first use.
+func loadCA() (*certs.CA, error) {
+	dir, err := certs.CADir()
+	if err != nil {
+		return nil, fmt.Errorf("locating CA directory: %w", err)
+	}
+	ca, created, err := certs.LoadOrCreateCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		fmt.Fprintf(os.Stderr, "[shadowfax] Created a local CA in %s\n", dir)
+		fmt.Fprintf(os.Stderr, "[shadowfax] Trust %s to avoid certificate warnings\n", ca.CertPath())
+	}
+	return ca, nil
+}
+
+// proxyTLSConfig returns the TLS config of the proxy, or nil when HTTPS is
+// disabled. Leaf certificates are kept in tmp/certs.
+func proxyTLSConfig(cfg *config.Config, wd string) (*tls.Config, error) {
+	if !cfg.HTTPS.Enabled {
+		return nil, nil
+	}
+	ca, err := loadCA()
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := ca.Leaf(filepath.Join(wd, "tmp", "certs"), cfg.HTTPS.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{leaf},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// runCACommand implements `shadowfax ca` by printing the path of the CA
+// certificate to trust.
+func runCACommand(out io.Writer) error {
+	ca, err := loadCA()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, ca.CertPath())
+	return nil
+}
+
+// controlClient returns the client and base URL used to reach a running
+// shadowfax from another terminal.
+func controlClient(proxyPort string) (*http.Client, string, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, "", err
+	}
+	cfg, err := config.Load(wd)
+	if err != nil {
+		return nil, "", err
+	}
+	if !cfg.HTTPS.Enabled {
+		return client, "http://localhost:" + proxyPort, nil
+	}
+
+	ca, err := loadCA()
+	if err != nil {
+		return nil, "", err
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool()}}
+	return client, "https://localhost:" + proxyPort, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -16,11 +18,15 @@ import (
 
 	"github.com/joho/godotenv"
 
+	"github.com/mbvlabs/shadowfax/internal/changes"
 	"github.com/mbvlabs/shadowfax/internal/config"
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+	"github.com/mbvlabs/shadowfax/internal/metrics"
 	"github.com/mbvlabs/shadowfax/internal/proxy"
 	"github.com/mbvlabs/shadowfax/internal/reload"
 	"github.com/mbvlabs/shadowfax/internal/server"
 	"github.com/mbvlabs/shadowfax/internal/state"
+	"github.com/mbvlabs/shadowfax/internal/testrun"
 	"github.com/mbvlabs/shadowfax/internal/watcher"
 )
 
@@ -53,6 +59,23 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		_ = godotenv.Load()
+		if err := runRollbackCommand(envOr("PROXY_PORT", DefaultProxyPort)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := runCACommand(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
 		cancel()
@@ -65,100 +88,160 @@ func main() {
 
 	fmt.Printf("Starting shadowfax (version %s)\n", Version)
 
-	proxyPort := os.Getenv("PROXY_PORT")
-	if proxyPort == "" {
-		proxyPort = DefaultProxyPort
+	proxyPort := envOr("PROXY_PORT", DefaultProxyPort)
+	appPort := envOr("PORT", DefaultAppPort)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg, err := config.Load(wd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	envData := config.EnvData{AppPort: appPort, ProxyPort: proxyPort, ProjectDir: wd}
+	processEnv := make(map[string][]string)
+	for _, target := range []string{config.TargetApp, config.TargetTempl, config.TargetTailwind, config.TargetNpm, config.TargetAssets, config.TargetRules, config.TargetMigrations} {
+		env, err := cfg.ResolveEnv(target, envData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		processEnv[target] = env
+	}
+
+	tlsConfig, err := proxyTLSConfig(cfg, wd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
-	appPort := os.Getenv("PORT")
-	if appPort == "" {
-		appPort = DefaultAppPort
+
+	templInProcess, templModeReason := useTemplInProcess(cfg, wd)
+	if err := checkTemplVersion(ctx, wd, templInProcess, cfg.Templ.StrictVersion); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
 	broadcaster := reload.NewBroadcaster()
-	rebuildChan := make(chan struct{}, 1)
-	templChange := make(chan watcher.TemplChange, 64)
+	rebuildChan := make(chan changes.Set, 1)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	trk := state.New()
+	trk.OnChange(func() {
+		broadcaster.SetStatus(reload.StatusMessage(trk.Errors()))
+	})
 	var wg sync.WaitGroup
-	errChan := make(chan error, 6)
+	errChan := make(chan error, 3)
 	var rebuildInProgress atomic.Bool
+	readyChan := make(chan struct{}, 1)
+	recorder := metrics.NewRecorder(metrics.DefaultHistory)
+
+	var testRunner *testrun.Runner
+	if os.Getenv("SHADOWFAX_TESTS") == "true" {
+		testRunner = testrun.New(testrun.Config{
+			Verbose:      verbose,
+			StateTracker: trk,
+			AddProcess:   addProcess,
+		})
+	}
 
-	// Start proxy server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := runProxyServer(ctx, proxyPort, appPort, broadcaster, rebuildInProgress.Load); err != nil {
-			errChan <- fmt.Errorf("proxy-server: %w", err)
+	// Migrations run before the app starts, so the gate is wired into the
+	// app server and the watcher only asks for restarts.
+	var migrations *watcher.MigrationsWatcher
+	var beforeStart func(context.Context) error
+	if cfg.Migrations.Command != "" {
+		migrations = &watcher.MigrationsWatcher{
+			Verbose: verbose,
+			OnError: func(msg string) { trk.SetError(state.IndexMigrations, msg) },
+			Env:     processEnv[config.TargetMigrations],
+			Dir:     cfg.Migrations.MigrationsDir(),
+			Command: cfg.Migrations.Command,
+			Status:  cfg.Migrations.Status,
 		}
-	}()
+		beforeStart = migrations.BeforeStart
+	}
 
-	// Start Go file watcher
+	appServer := server.NewAppServer(server.Config{
+		AppPort:      appPort,
+		Broadcaster:  broadcaster,
+		AddProcess:   addProcess,
+		ReadyChan:    readyChan,
+		StateTracker: trk,
+		ClearLogs:    clearLogs,
+		OnRebuildStateChanged: func(inProgress bool) {
+			rebuildInProgress.Store(inProgress)
+		},
+		OnRebuild: func(set changes.Set) {
+			if testRunner != nil {
+				testRunner.Trigger(ctx, set.Paths())
+			}
+		},
+		KeepBuilds: keepBuildsFromEnv(),
+		Metrics:    recorder,
+		Env: func(buildID string) ([]string, error) {
+			data := envData
+			data.BuildID = buildID
+			return cfg.ResolveEnv(config.TargetApp, data)
+		},
+		BeforeStart: beforeStart,
+	})
+
+	routes := map[string]http.Handler{
+		rollbackPath: rollbackHandler(appServer),
+		statsPath:    recorder,
+	}
+
+	// Start proxy server
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := watcher.RunGoWatcher(ctx, rebuildChan, verbose); err != nil {
-			errChan <- fmt.Errorf("go-watcher: %w", err)
+		if err := runProxyServer(ctx, proxyPort, appPort, broadcaster, rebuildInProgress.Load, routes, tlsConfig, cfg.HTTP2, cfg.Client, cfg.Hold); err != nil {
+			errChan <- fmt.Errorf("proxy-server: %w", err)
 		}
 	}()
 
-	// Start templ watcher
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		cfg := watcher.TemplWatcherConfig{
-			Verbose:    verbose,
-			AddProcess: addProcess,
-			OnTemplErr: func(msg string) {
-				trk.SetError(state.IndexTempl, msg)
+	watchers := []dispatch.Watcher{
+		watcher.GoWatcher{Config: watcher.GoWatcherConfig{
+			Verbose: verbose,
+			Filter: watcher.FilterConfig{
+				Include:   cfg.Watch.Include,
+				Exclude:   cfg.Watch.Exclude,
+				Gitignore: cfg.Watch.UseGitignore(),
 			},
+			Backend:      cfg.Watch.Backend,
+			PollInterval: cfg.Watch.Interval(),
+		}},
+	}
+
+	templWatcher := watcher.TemplWatcher{Config: watcher.TemplWatcherConfig{
+		Verbose:    verbose,
+		AddProcess: addProcess,
+		Env:        processEnv[config.TargetTempl],
+		InProcess:  templInProcess,
+	}}
+	if !cfg.UseTemplDevMode() {
+		templWatcher.Regenerate = func(ctx context.Context) error {
+			return generateTempl(ctx, templInProcess, processEnv[config.TargetTempl])
 		}
-		if err := watcher.RunTemplWatcher(ctx, templChange, cfg); err != nil {
-			errChan <- fmt.Errorf("live-templ: %w", err)
-		}
-	}()
+	}
+	watchers = append(watchers, templWatcher)
 
 	useTailwind, err := config.ShouldUseTailwind()
 	if err != nil && verbose {
 		fmt.Printf("[shadowfax] Tailwind detection error: %v\n", err)
 	}
-
-	var cssRebuilt chan struct{}
-
-	if useTailwind {
-		cssRebuilt = make(chan struct{}, 1)
-
-		// Start tailwind watcher
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			cfg := watcher.TailwindConfig{
-				Verbose:    verbose,
-				AddProcess: addProcess,
-			}
-			if err := watcher.RunTailwindWatcher(ctx, cssRebuilt, cfg); err != nil {
-				errChan <- fmt.Errorf("live-tailwind: %w", err)
-			}
-		}()
-
-		// Handle CSS rebuild events from tailwind
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-cssRebuilt:
-					if !rebuildInProgress.Load() {
-						fmt.Println("[shadowfax] CSS rebuilt, broadcasting reload")
-						broadcaster.Broadcast()
-					} else if verbose {
-						fmt.Println("[shadowfax] CSS rebuilt (server restart in progress, skipping broadcast)")
-					}
-				}
-			}
-		}()
+	if useTailwind || len(cfg.Tailwind.Entries) > 0 {
+		watchers = append(watchers, watcher.TailwindWatcher{Config: watcher.TailwindConfig{
+			Verbose:    verbose,
+			AddProcess: addProcess,
+			Env:        processEnv[config.TargetTailwind],
+			CLI:        cfg.Tailwind.TailwindCLI(),
+			Entries:    cfg.Tailwind.TailwindEntries(),
+		}})
 	} else if verbose {
 		fmt.Println("[shadowfax] Tailwind watcher disabled")
 	}
@@ -167,46 +250,65 @@ func main() {
 	if err != nil && verbose {
 		fmt.Printf("[shadowfax] Inertia detection error: %v\n", err)
 	}
-
 	if useInertia {
 		fmt.Println("[shadowfax] Starting npm run dev (Inertia frontend)")
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := runNpmDev(ctx); err != nil {
-				errChan <- fmt.Errorf("npm-run-dev: %w", err)
-			}
-		}()
+		watchers = append(watchers, dispatch.Func("npm-run-dev", func(ctx context.Context, _ chan<- dispatch.Event) error {
+			return runNpmDev(ctx, processEnv[config.TargetNpm])
+		}))
 	} else if verbose {
 		fmt.Println("[shadowfax] Inertia frontend not detected")
 	}
 
-	readyChan := make(chan struct{}, 1)
+	if cfg.Assets.Command != "" {
+		watchers = append(watchers, watcher.AssetsWatcher{
+			Config: watcher.AssetsConfig{
+				Verbose:    verbose,
+				AddProcess: addProcess,
+				Env:        processEnv[config.TargetAssets],
+				Command:    cfg.Assets.Command,
+				Watch:      cfg.Assets.Watch,
+				Done:       cfg.Assets.Done,
+				Error:      cfg.Assets.Error,
+				Sources:    cfg.Assets.Sources,
+				Exclude:    cfg.Assets.Exclude,
+			},
+			Reload: cfg.Assets.Reload,
+		})
+	}
+
+	if migrations != nil {
+		watchers = append(watchers, migrations)
+	}
+
+	if len(cfg.Rules) > 0 {
+		watchers = append(watchers, watcher.RulesWatcher{
+			Verbose:    verbose,
+			AddProcess: addProcess,
+			Env:        processEnv[config.TargetRules],
+			Rules:      cfg.Rules,
+		})
+	}
 
-	// Clear rebuildInProgress when app server is ready
+	dispatcher := dispatch.New(dispatch.Config{
+		Verbose:           verbose,
+		Broadcaster:       broadcaster,
+		Tracker:           trk,
+		Rebuild:           rebuildChan,
+		Restart:           appServer.Restart,
+		RebuildInProgress: &rebuildInProgress,
+		Ready:             readyChan,
+		ClearLogs:         clearLogs,
+	}, watchers...)
+
+	wg.Add(1)
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-readyChan:
-				rebuildInProgress.Store(false)
-			}
+		defer wg.Done()
+		if err := dispatcher.Run(ctx); err != nil {
+			errChan <- err
 		}
 	}()
 
 	// App server manager
-	appServer := server.NewAppServer(server.Config{
-		AppPort:      appPort,
-		Broadcaster:  broadcaster,
-		AddProcess:   addProcess,
-		ReadyChan:    readyChan,
-		StateTracker: trk,
-		ClearLogs:    clearLogs,
-		OnRebuildStateChanged: func(inProgress bool) {
-			rebuildInProgress.Store(inProgress)
-		},
-	})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -215,62 +317,56 @@ func main() {
 		}
 	}()
 
-	// Handle templ changes
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case change := <-templChange:
-				switch change {
-			case watcher.TemplChangeNeedsBrowserReload:
-				if clearLogs != nil {
-					clearLogs()
-				}
-				if trk.HasErrorAt(state.IndexTempl) {
-					fmt.Println("[shadowfax] Templ has errors, skipping browser reload")
-					continue
-				}
-				if useTailwind {
-						fmt.Println("[shadowfax] Template changed, triggering CSS rebuild")
-						if err := touchFile("./css/base.css"); err != nil {
-							fmt.Printf("[shadowfax] Warning: could not touch CSS file: %v\n", err)
-							// Fall back to broadcasting directly
-							broadcaster.Broadcast()
-						}
-					} else {
-						fmt.Println("[shadowfax] Template changed, reloading browser")
-						broadcaster.Broadcast()
-					}
-				case watcher.TemplChangeNeedsRestart:
-					if trk.HasErrorAt(state.IndexTempl) {
-						fmt.Println("[shadowfax] Templ has errors, skipping rebuild")
-						continue
-					}
-					fmt.Println("[shadowfax] Template Go code changed, rebuilding")
-					if useTailwind {
-						rebuildInProgress.Store(true)
-						if err := touchFile("./css/base.css"); err != nil && verbose {
-							fmt.Printf("[shadowfax] Warning: could not touch CSS file: %v\n", err)
-						}
-					}
-					select {
-					case rebuildChan <- struct{}{}:
-					default:
-					}
-				}
-			}
-		}
-	}()
-
-	fmt.Printf("\n  Proxy server: http://localhost:%s\n", proxyPort)
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	fmt.Printf("\n  Proxy server: %s://localhost:%s\n", scheme, proxyPort)
 	fmt.Printf("  App server:   http://localhost:%s (internal)\n", appPort)
-	fmt.Printf("  TEMPL_DEV_MODE: enabled (fast template reloads)\n")
+	if cfg.UseTemplDevMode() {
+		fmt.Printf("  TEMPL_DEV_MODE: enabled (fast template reloads)\n")
+	} else {
+		fmt.Printf("  TEMPL_DEV_MODE: disabled (template changes rebuild the app)\n")
+	}
+	if templInProcess {
+		fmt.Printf("  templ: in-process generator (%s)\n", watcher.TemplGeneratorVersion())
+	} else {
+		fmt.Printf("  templ: bin/templ (%s)\n", templModeReason)
+	}
+	printEnvOverrides(processEnv)
 	if useInertia {
 		fmt.Printf("  Inertia frontend: npm run dev (Vite dev server)\n")
 	}
+	if cfg.Assets.Command != "" {
+		mode := "on change in " + strings.Join(cfg.Assets.AssetsSources(), ", ")
+		if cfg.Assets.Watch {
+			mode = "watch mode"
+		}
+		fmt.Printf("  Assets: %s (%s)\n", cfg.Assets.Command, mode)
+	}
+	if migrations != nil {
+		fmt.Printf("  Migrations: %s on changes in %s\n", cfg.Migrations.Command, migrations.Dir)
+	}
+	for _, rule := range cfg.Rules {
+		action := rule.Action
+		if action == "" {
+			action = config.RuleActionNone
+		}
+		fmt.Printf("  Rule %s: %s -> %s\n", rule.Name, strings.Join(rule.Match, ", "), action)
+	}
+	if testRunner != nil {
+		fmt.Printf("  Tests: go test on affected packages after each change\n")
+	}
+	if cfg.Hold.Enabled {
+		fmt.Printf("  Hold: requests during restarts wait up to %s\n", cfg.Hold.MaxWaitDuration())
+	}
+	fmt.Printf("  Build stats: %s://localhost:%s%s\n", scheme, proxyPort, statsPath)
+	fmt.Printf("  Requests: %s://localhost:%s%s\n", scheme, proxyPort, proxy.InspectorPath)
+	fmt.Printf("  Rollback: type b + Enter, POST %s or run `shadowfax rollback`\n", rollbackPath)
 	fmt.Println()
 
+	go watchKeyboard(ctx, os.Stdin, appServer)
+
 	go func() {
 		select {
 		case sig := <-sigChan:
@@ -374,6 +470,11 @@ func runProxyServer(
 	proxyPort, appPort string,
 	broadcaster *reload.Broadcaster,
 	isRebuilding func() bool,
+	routes map[string]http.Handler,
+	tlsConfig *tls.Config,
+	http2 config.HTTP2Config,
+	client config.ClientConfig,
+	hold config.HoldConfig,
 ) error {
 	targetURL := fmt.Sprintf("http://localhost:%s", appPort)
 
@@ -382,12 +483,37 @@ func runProxyServer(
 		return err
 	}
 
+	for pattern, route := range routes {
+		proxyServer.Handle(pattern, route)
+	}
+	if http2.Upstream {
+		proxyServer.UseUpstreamH2C()
+	}
+	if client.Inline {
+		proxyServer.InlineClient()
+	}
+	if hold.Enabled {
+		proxyServer.HoldRequests(hold.MaxWaitDuration(), hold.MaxBodyBytes())
+	}
+
 	wsHandler := reload.NewWebSocketHandler(broadcaster)
 	handler := proxyServer.Handler(wsHandler)
 
+	// Browsers only negotiate HTTP/2 over TLS; plain HTTP/2 is h2c with
+	// prior knowledge. The reload websocket is an HTTP/1.1 upgrade, which
+	// browsers open on a separate HTTP/1.1 connection.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if http2.UseBrowser() {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
 	server := &http.Server{
-		Addr:    ":" + proxyPort,
-		Handler: handler,
+		Addr:      ":" + proxyPort,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		Protocols: protocols,
 	}
 
 	listener, err := net.Listen("tcp", server.Addr)
@@ -397,7 +523,13 @@ func runProxyServer(
 
 	serveErr := make(chan error, 1)
 	go func() {
-		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			serveErr <- err
 		}
 	}()
@@ -412,13 +544,85 @@ func runProxyServer(
 	}
 }
 
-// touchFile updates the modification time of a file to trigger file watchers.
-func touchFile(path string) error {
-	now := time.Now()
-	return os.Chtimes(path, now, now)
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
 }
 
-func runNpmDev(ctx context.Context) error {
+// printEnvOverrides lists the env keys each process gets on top of the
+// shadowfax environment. Values are not printed since they may be secrets.
+// TEMPL_DEV_MODE has its own banner line.
+func printEnvOverrides(processEnv map[string][]string) {
+	base := os.Environ()
+	for _, target := range []string{config.TargetApp, config.TargetTempl, config.TargetTailwind, config.TargetNpm, config.TargetAssets, config.TargetRules, config.TargetMigrations} {
+		var overrides []string
+		for _, kv := range processEnv[target] {
+			if !strings.HasPrefix(kv, "TEMPL_DEV_MODE=") {
+				overrides = append(overrides, kv)
+			}
+		}
+		added, overridden := config.DiffEnvKeys(base, overrides)
+		if len(added) == 0 && len(overridden) == 0 {
+			continue
+		}
+		line := fmt.Sprintf("  Env (%s):", target)
+		if len(added) > 0 {
+			line += " added " + strings.Join(added, ", ")
+		}
+		if len(overridden) > 0 {
+			if len(added) > 0 {
+				line += ";"
+			}
+			line += " overridden " + strings.Join(overridden, ", ")
+		}
+		fmt.Println(line)
+	}
+}
+
+// useTemplInProcess decides whether templ runs in-process. When it doesn't,
+// the reason is returned for the startup banner.
+func useTemplInProcess(cfg *config.Config, dir string) (bool, string) {
+	switch cfg.Templ.Mode {
+	case config.TemplModeInProcess:
+		return true, ""
+	case config.TemplModeSubprocess:
+		return false, "templ.mode is subprocess"
+	}
+
+	if len(cfg.Env[config.TargetTempl]) > 0 {
+		return false, "templ env overrides need a separate process"
+	}
+	version, err := config.TemplModuleVersion(dir)
+	if err != nil || version == "" {
+		return false, "no templ version in go.mod"
+	}
+	if bundled := watcher.TemplGeneratorVersion(); version != bundled {
+		return false, fmt.Sprintf("go.mod has templ %s, shadowfax bundles %s", version, bundled)
+	}
+	return true, ""
+}
+
+// generateTempl runs a one-shot `templ generate` so template text is compiled
+// into the Go code again.
+func generateTempl(ctx context.Context, inProcess bool, env []string) error {
+	if inProcess {
+		return watcher.GenerateTempl(ctx, verbose)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, wd+"/bin/templ", "generate")
+	cmd.Dir = wd
+	cmd.Env = config.MergeEnv(os.Environ(), env)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func runNpmDev(ctx context.Context, env []string) error {
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -426,6 +630,9 @@ func runNpmDev(ctx context.Context) error {
 
 	cmd := exec.CommandContext(ctx, "npm", "run", "dev")
 	cmd.Dir = wd
+	if len(env) > 0 {
+		cmd.Env = config.MergeEnv(os.Environ(), env)
+	}
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -2,220 +2,277 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"sync/atomic"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
 	"github.com/mbvlabs/shadowfax/internal/reload"
+	"github.com/mbvlabs/shadowfax/internal/server"
 )
 
-func TestTouchFileUpdatesMtime(t *testing.T) {
-	f, err := os.CreateTemp(t.TempDir(), "touch-test-*")
+func TestRunProxyServerFailsFastWhenPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	f.Close()
+	defer listener.Close()
 
-	before, err := os.Stat(f.Name())
+	_, port, err := net.SplitHostPort(listener.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Ensure clock advances
-	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if err := touchFile(f.Name()); err != nil {
-		t.Fatal(err)
+	start := time.Now()
+	err = runProxyServer(ctx, port, "8080", reload.NewBroadcaster(), nil, nil, nil, config.HTTP2Config{}, config.ClientConfig{}, config.HoldConfig{})
+	if err == nil {
+		t.Fatal("expected bind error when proxy port is already in use")
 	}
 
-	after, err := os.Stat(f.Name())
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected startup failure to return quickly, took %s", time.Since(start))
+	}
+}
+
+// startTestProxy runs the proxy without an app behind it and waits until it
+// accepts connections. The stats route echoes the request protocol.
+func startTestProxy(t *testing.T, tlsConfig *tls.Config, http2 config.HTTP2Config) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
 
-	if !after.ModTime().After(before.ModTime()) {
-		t.Error("touchFile should update the file's modification time")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	routes := map[string]http.Handler{
+		statsPath: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+	}
+	go runProxyServer(ctx, port, "1", reload.NewBroadcaster(), nil, routes, tlsConfig, http2, config.ClientConfig{}, config.HoldConfig{})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err == nil {
+			conn.Close()
+			return port
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func TestTouchFileErrorOnMissingFile(t *testing.T) {
-	err := touchFile(t.TempDir() + "/nonexistent")
-	if err == nil {
-		t.Error("touchFile should return an error for a nonexistent file")
+func getProto(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
 	}
+	return string(body)
 }
 
-// TestCSSRebuiltBroadcastsWhenIdle verifies that a CSS rebuild triggers a
-// browser reload when no Go rebuild is in progress (the TemplChangeNeedsBrowserReload path).
-func TestCSSRebuiltBroadcastsWhenIdle(t *testing.T) {
-	broadcaster := reload.NewBroadcaster()
-	listener := broadcaster.Subscribe()
-	defer broadcaster.Unsubscribe(listener)
-
-	cssRebuilt := make(chan struct{}, 1)
-	var rebuildInProgress atomic.Bool
-
-	go func() {
-		<-cssRebuilt
-		if !rebuildInProgress.Load() {
-			broadcaster.Broadcast()
-		}
-	}()
+func dialReloadSocket(t *testing.T, dialer *websocket.Dialer, url string) {
+	t.Helper()
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("reload websocket failed: %v", err)
+	}
+	resp.Body.Close()
+	conn.Close()
+}
 
-	cssRebuilt <- struct{}{}
+func TestRunProxyServerServesHTTPS(t *testing.T) {
+	t.Setenv("SHADOWFAX_CAROOT", filepath.Join(t.TempDir(), "ca"))
+	wd := t.TempDir()
+	t.Chdir(wd)
+	if err := os.WriteFile(filepath.Join(wd, config.FileName), []byte(`{"https": {"enabled": true}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := proxyTLSConfig(cfg, wd)
+	if err != nil {
+		t.Fatalf("proxyTLSConfig returned error: %v", err)
+	}
+	port := startTestProxy(t, tlsConfig, cfg.HTTP2)
 
-	select {
-	case <-listener:
-		// Expected: CSS rebuild with no Go rebuild in progress should broadcast.
-	case <-time.After(time.Second):
-		t.Fatal("expected broadcast after CSS rebuild when idle")
+	client, baseURL, err := controlClient(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(baseURL, "https://") {
+		t.Fatalf("expected an https base URL, got %s", baseURL)
+	}
+	if proto := getProto(t, client, baseURL+statsPath); proto != "HTTP/1.1" {
+		t.Fatalf("expected HTTP/1.1 without ALPN h2, got %s", proto)
 	}
-}
 
-// TestCSSRebuiltSuppressedDuringRestart verifies that a CSS rebuild does NOT
-// trigger a browser reload while a Go rebuild is in progress
-// (the TemplChangeNeedsRestart path). The app server's health-check broadcast
-// handles the reload instead.
-func TestCSSRebuiltSuppressedDuringRestart(t *testing.T) {
-	broadcaster := reload.NewBroadcaster()
-	listener := broadcaster.Subscribe()
-	defer broadcaster.Unsubscribe(listener)
+	roots := client.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	h2 := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	if proto := getProto(t, h2, baseURL+statsPath); proto != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2 over TLS, got %s", proto)
+	}
 
-	cssRebuilt := make(chan struct{}, 1)
-	var rebuildInProgress atomic.Bool
-	rebuildInProgress.Store(true)
+	dialReloadSocket(t, &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}, "wss://localhost:"+port+reload.WebSocketPath)
+}
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		<-cssRebuilt
-		if !rebuildInProgress.Load() {
-			broadcaster.Broadcast()
-		}
-	}()
+func TestRunProxyServerServesH2C(t *testing.T) {
+	port := startTestProxy(t, nil, config.HTTP2Config{})
 
-	cssRebuilt <- struct{}{}
-	<-done
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	if proto := getProto(t, h2c, "http://localhost:"+port+statsPath); proto != "HTTP/2.0" {
+		t.Fatalf("expected h2c, got %s", proto)
+	}
+	if proto := getProto(t, http.DefaultClient, "http://localhost:"+port+statsPath); proto != "HTTP/1.1" {
+		t.Fatalf("expected HTTP/1.1 to stay available, got %s", proto)
+	}
+	dialReloadSocket(t, websocket.DefaultDialer, "ws://localhost:"+port+reload.WebSocketPath)
 
-	select {
-	case <-listener:
-		t.Fatal("should not broadcast CSS rebuild while Go rebuild is in progress")
-	case <-time.After(100 * time.Millisecond):
-		// Expected: broadcast suppressed.
+	disabled := false
+	port = startTestProxy(t, nil, config.HTTP2Config{Browser: &disabled})
+	if _, err := h2c.Get("http://localhost:" + port + statsPath); err == nil {
+		t.Fatal("expected h2c to be refused with HTTP/2 disabled")
 	}
 }
 
-// TestReadyChanClearsRebuildInProgress verifies that the app server's ready
-// signal allows subsequent CSS rebuilds to broadcast again.
-func TestReadyChanClearsRebuildInProgress(t *testing.T) {
-	var rebuildInProgress atomic.Bool
-	rebuildInProgress.Store(true)
-
-	readyChan := make(chan struct{}, 1)
+type fakeRollbacker struct {
+	build server.Build
+	err   error
+}
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		<-readyChan
-		rebuildInProgress.Store(false)
-	}()
+func (f fakeRollbacker) Rollback() (server.Build, error) {
+	return f.build, f.err
+}
 
-	readyChan <- struct{}{}
-	<-done
+func TestRollbackHandlerRejectsGET(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rollbackHandler(fakeRollbacker{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, rollbackPath, nil))
 
-	if rebuildInProgress.Load() {
-		t.Fatal("rebuildInProgress should be cleared after readyChan signal")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
 	}
 }
 
-// TestFullRestartCycle verifies the complete TemplChangeNeedsRestart flow:
-// 1. rebuildInProgress is set
-// 2. CSS rebuild during Go rebuild is suppressed
-// 3. readyChan clears rebuildInProgress
-// 4. A subsequent CSS rebuild broadcasts normally
-func TestFullRestartCycle(t *testing.T) {
-	broadcaster := reload.NewBroadcaster()
-	listener := broadcaster.Subscribe()
-	defer broadcaster.Unsubscribe(listener)
+func TestRollbackHandlerReportsMissingBuild(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handler := rollbackHandler(fakeRollbacker{err: server.ErrNoPreviousBuild})
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, rollbackPath, nil))
 
-	cssRebuilt := make(chan struct{}, 1)
-	readyChan := make(chan struct{}, 1)
-	var rebuildInProgress atomic.Bool
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 when no previous build exists, got %d", rec.Code)
+	}
+}
 
-	// Start the CSS rebuild handler (mirrors main.go goroutine)
-	go func() {
-		for range cssRebuilt {
-			if !rebuildInProgress.Load() {
-				broadcaster.Broadcast()
-			}
-		}
-	}()
+func TestRollbackHandlerReturnsBuild(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handler := rollbackHandler(fakeRollbacker{build: server.Build{ID: "server_1"}})
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, rollbackPath, nil))
 
-	// Start the ready handler (mirrors main.go goroutine)
-	go func() {
-		for range readyChan {
-			rebuildInProgress.Store(false)
-		}
-	}()
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"id":"server_1"`) {
+		t.Fatalf("expected build in response body, got %q", rec.Body.String())
+	}
+}
 
-	// Step 1: Simulate TemplChangeNeedsRestart — set flag
-	rebuildInProgress.Store(true)
+func writeTemplProject(t *testing.T, moduleVersion, cliOutput string) string {
+	t.Helper()
+	dir := t.TempDir()
+	gomod := "module example.com/app\n\ngo 1.25\n\nrequire github.com/a-h/templ " + moduleVersion + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/usr/bin/env sh\necho '" + cliOutput + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "bin", "templ"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
 
-	// Step 2: Tailwind finishes CSS rebuild during Go rebuild — should be suppressed
-	cssRebuilt <- struct{}{}
-	time.Sleep(50 * time.Millisecond)
+func TestTemplCLIVersion(t *testing.T) {
+	dir := writeTemplProject(t, "v0.3.960", "v0.3.960")
+	if v, err := templCLIVersion(context.Background(), dir); err != nil || v != "v0.3.960" {
+		t.Fatalf("templCLIVersion = %q, %v", v, err)
+	}
 
-	select {
-	case <-listener:
-		t.Fatal("CSS rebuild during Go restart should not broadcast")
-	default:
+	dir = writeTemplProject(t, "v0.3.960", "not a version")
+	if _, err := templCLIVersion(context.Background(), dir); err == nil {
+		t.Fatal("expected error for unparseable output")
 	}
+}
 
-	// Step 3: App server becomes healthy — clears flag
-	readyChan <- struct{}{}
-	time.Sleep(50 * time.Millisecond)
+func TestCheckTemplVersionStrictMismatch(t *testing.T) {
+	dir := writeTemplProject(t, "v0.3.977", "v0.3.960")
 
-	if rebuildInProgress.Load() {
-		t.Fatal("rebuildInProgress should be cleared after ready signal")
+	err := checkTemplVersion(context.Background(), dir, false, true)
+	var mismatch *templVersionMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected mismatch error, got %v", err)
+	}
+	if mismatch.generator != "v0.3.960" || mismatch.module != "v0.3.977" {
+		t.Fatalf("unexpected mismatch: %+v", mismatch)
 	}
 
-	// Step 4: Next CSS rebuild should broadcast (e.g. from a subsequent templ change)
-	// Wait for broadcaster debounce to expire
-	time.Sleep(60 * time.Millisecond)
-	cssRebuilt <- struct{}{}
-
-	select {
-	case <-listener:
-		// Expected: broadcast succeeds after rebuild cycle completes.
-	case <-time.After(time.Second):
-		t.Fatal("CSS rebuild after restart cycle should broadcast")
+	if err := checkTemplVersion(context.Background(), dir, false, false); err != nil {
+		t.Fatalf("expected only a warning without strict mode, got %v", err)
 	}
 }
 
-func TestRunProxyServerFailsFastWhenPortInUse(t *testing.T) {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
+func TestCheckTemplVersionStrictUnknownVersion(t *testing.T) {
+	dir := writeTemplProject(t, "v0.3.977", "not a version")
+	if err := checkTemplVersion(context.Background(), dir, false, true); err == nil {
+		t.Fatal("expected an error when the bin/templ version can't be determined in strict mode")
+	}
+	if err := checkTemplVersion(context.Background(), dir, false, false); err != nil {
+		t.Fatalf("expected the check to be skipped without strict mode, got %v", err)
 	}
-	defer listener.Close()
 
-	_, port, err := net.SplitHostPort(listener.Addr().String())
-	if err != nil {
+	if err := os.Remove(filepath.Join(dir, "bin", "templ")); err != nil {
 		t.Fatal(err)
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	start := time.Now()
-	err = runProxyServer(ctx, port, "8080", reload.NewBroadcaster(), nil)
-	if err == nil {
-		t.Fatal("expected bind error when proxy port is already in use")
+	if err := checkTemplVersion(context.Background(), dir, false, true); err == nil {
+		t.Fatal("expected an error for a missing bin/templ in strict mode")
 	}
+}
 
-	if time.Since(start) > time.Second {
-		t.Fatalf("expected startup failure to return quickly, took %s", time.Since(start))
+func TestCheckTemplVersionMatch(t *testing.T) {
+	dir := writeTemplProject(t, "v0.3.977", "v0.3.977")
+	if err := checkTemplVersion(context.Background(), dir, false, true); err != nil {
+		t.Fatalf("expected matching versions to pass, got %v", err)
 	}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
+	"github.com/mbvlabs/shadowfax/internal/watcher"
+)
+
+// templVersionMismatch is returned by checkTemplVersion in strict mode.
+type templVersionMismatch struct {
+	generator, module string
+}
+
+func (e *templVersionMismatch) Error() string {
+	return fmt.Sprintf("templ generator %s does not match %s %s in go.mod (templ.strictVersion is set)", e.generator, config.TemplModulePath, e.module)
+}
+
+// checkTemplVersion compares the templ generator in use with the templ
+// version required by go.mod. A mismatch is printed as a warning, or
+// returned as an error when strict is set. Missing versions are skipped,
+// except in strict mode, where they are an error too.
+func checkTemplVersion(ctx context.Context, dir string, inProcess, strict bool) error {
+	module, err := config.TemplModuleVersion(dir)
+	if err != nil || module == "" {
+		if err == nil {
+			err = fmt.Errorf("no templ requirement in go.mod")
+		}
+		return skipTemplVersionCheck(err, strict)
+	}
+
+	source := "bundled generator"
+	generator := watcher.TemplGeneratorVersion()
+	if !inProcess {
+		source = "bin/templ"
+		if generator, err = templCLIVersion(ctx, dir); err != nil {
+			return skipTemplVersionCheck(err, strict)
+		}
+	}
+
+	if semver.Compare(generator, module) == 0 {
+		return nil
+	}
+	if strict {
+		return &templVersionMismatch{generator: generator, module: module}
+	}
+
+	fmt.Println()
+	fmt.Println("[shadowfax] WARNING: templ version mismatch")
+	fmt.Printf("[shadowfax]   %-18s %s\n", source+":", generator)
+	fmt.Printf("[shadowfax]   %-18s %s\n", "go.mod:", module)
+	fmt.Println("[shadowfax]   Generated code may not compile and TEMPL_DEV_MODE text files may not load.")
+	if inProcess {
+		fmt.Printf("[shadowfax]   Run `go get %s@%s` or set templ.mode to subprocess.\n", config.TemplModulePath, generator)
+	} else {
+		fmt.Printf("[shadowfax]   Run `GOBIN=%s go install %s/cmd/templ@%s`\n", filepath.Join(dir, "bin"), config.TemplModulePath, module)
+		fmt.Printf("[shadowfax]   or `go get %s@%s`.\n", config.TemplModulePath, generator)
+	}
+	fmt.Println()
+	return nil
+}
+
+// skipTemplVersionCheck reports that a version couldn't be determined. In
+// strict mode that fails the check.
+func skipTemplVersionCheck(err error, strict bool) error {
+	if strict {
+		return fmt.Errorf("templ version check: %w (templ.strictVersion is set)", err)
+	}
+	if verbose {
+		fmt.Printf("[shadowfax] templ version check skipped: %v\n", err)
+	}
+	return nil
+}
+
+// templCLIVersion runs `bin/templ version`.
+func templCLIVersion(ctx context.Context, dir string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, filepath.Join(dir, "bin", "templ"), "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("bin/templ version: %w", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("bin/templ version: empty output")
+	}
+	version := fields[len(fields)-1]
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if !semver.IsValid(version) {
+		return "", fmt.Errorf("bin/templ version: unexpected output %q", strings.TrimSpace(string(out)))
+	}
+	return version, nil
+}
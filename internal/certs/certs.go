@@ -0,0 +1,246 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	caCertFile   = "rootCA.pem"
+	caKeyFile    = "rootCA-key.pem"
+	leafCertFile = "localhost.pem"
+	leafKeyFile  = "localhost-key.pem"
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+	// leafValidity stays below the 825 days Apple platforms accept.
+	leafValidity = 2 * 365 * 24 * time.Hour
+	// leafRenewBefore is how long before expiry a leaf is replaced.
+	leafRenewBefore = 30 * 24 * time.Hour
+)
+
+// DefaultHosts are included in every leaf certificate.
+var DefaultHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// CADir returns where the CA is kept: $SHADOWFAX_CAROOT, or shadowfax/ca in
+// the user config directory. Sharing it between projects means it only has
+// to be trusted once.
+func CADir() (string, error) {
+	if dir := os.Getenv("SHADOWFAX_CAROOT"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shadowfax", "ca"), nil
+}
+
+// CA is a local certificate authority.
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// LoadOrCreateCA loads the CA in dir, creating it first if dir holds none.
+// created reports whether a new CA was written.
+func LoadOrCreateCA(dir string) (ca *CA, created bool, err error) {
+	ca = &CA{dir: dir}
+	ca.cert, ca.key, err = readPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err == nil {
+		return ca, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, fmt.Errorf("loading CA from %s: %w", dir, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, false, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, false, err
+	}
+	host, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"shadowfax development CA"},
+			CommonName:   "shadowfax local CA " + host,
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writePair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile), der, key); err != nil {
+		return nil, false, err
+	}
+	ca.cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, false, err
+	}
+	ca.key = key
+	return ca, true, nil
+}
+
+// CertPath returns the path of the CA certificate, the file to trust.
+func (ca *CA) CertPath() string {
+	return filepath.Join(ca.dir, caCertFile)
+}
+
+// Pool returns a certificate pool holding only the CA.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Leaf returns a certificate for hosts and DefaultHosts, signed by the CA
+// and kept in dir. The stored certificate is reused while it covers every
+// host and isn't close to expiring.
+func (ca *CA) Leaf(dir string, hosts []string) (tls.Certificate, error) {
+	hosts = leafHosts(hosts)
+	certPath, keyPath := filepath.Join(dir, leafCertFile), filepath.Join(dir, leafKeyFile)
+
+	if cert, key, err := readPair(certPath, keyPath); err == nil && ca.covers(cert, hosts) {
+		return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"shadowfax development certificate"},
+			CommonName:   hosts[0],
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePair(certPath, keyPath, der, key); err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, nil
+}
+
+// covers reports whether cert was issued by the CA, is valid for every
+// host and stays valid for a while.
+func (ca *CA) covers(cert *x509.Certificate, hosts []string) bool {
+	if cert.CheckSignatureFrom(ca.cert) != nil || time.Until(cert.NotAfter) < leafRenewBefore {
+		return false
+	}
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func leafHosts(hosts []string) []string {
+	out := slices.Clone(DefaultHosts)
+	for _, h := range hosts {
+		if h != "" && !slices.Contains(out, h) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func readPair(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%s: no certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no private key found", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	return cert, key, nil
+}
+
+func writePair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
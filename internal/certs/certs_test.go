@@ -0,0 +1,79 @@
+package certs
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateCAPersists(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+
+	ca, created, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA returned error: %v", err)
+	}
+	if !created {
+		t.Fatal("expected a new CA")
+	}
+
+	again, created, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA returned error: %v", err)
+	}
+	if created || !again.cert.Equal(ca.cert) {
+		t.Fatal("expected the stored CA to be reused")
+	}
+	if again.CertPath() != filepath.Join(dir, caCertFile) {
+		t.Fatalf("unexpected CA path %s", again.CertPath())
+	}
+}
+
+func TestLeafCoversHostsAndIsReused(t *testing.T) {
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	leaf, err := ca.Leaf(dir, []string{"app.test"})
+	if err != nil {
+		t.Fatalf("Leaf returned error: %v", err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "app.test"} {
+		if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: ca.Pool()}); err != nil {
+			t.Fatalf("leaf not valid for %s: %v", host, err)
+		}
+	}
+
+	same, err := ca.Leaf(dir, []string{"app.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.Leaf.SerialNumber.Cmp(leaf.Leaf.SerialNumber) != 0 {
+		t.Fatal("expected the stored leaf to be reused")
+	}
+
+	wider, err := ca.Leaf(dir, []string{"app.test", "admin.app.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wider.Leaf.SerialNumber.Cmp(leaf.Leaf.SerialNumber) == 0 {
+		t.Fatal("expected a new leaf for a new host")
+	}
+	if err := wider.Leaf.VerifyHostname("admin.app.test"); err != nil {
+		t.Fatalf("new leaf not valid for added host: %v", err)
+	}
+
+	other, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromOther, err := other.Leaf(dir, []string{"app.test", "admin.app.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromOther.Leaf.CheckSignatureFrom(other.cert) != nil {
+		t.Fatal("expected a leaf signed by the other CA to replace the stored one")
+	}
+}
@@ -0,0 +1,156 @@
+package changes
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Op is what happened to a file.
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpWrite  Op = "write"
+	OpRemove Op = "remove"
+	OpRename Op = "rename"
+	OpChmod  Op = "chmod"
+)
+
+// File is one changed path and the operation seen for it.
+type File struct {
+	Path string `json:"path"`
+	Op   Op     `json:"op"`
+}
+
+// Set is the distinct files that changed within one debounce window. Reason
+// describes changes that don't map to watched files, e.g. templ output.
+type Set struct {
+	Detected time.Time `json:"detected"`
+	Fired    time.Time `json:"fired"`
+	Files    []File    `json:"files,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Add records op for path, folding it into an earlier operation on the same
+// file: a file created and then written is still new, while a later remove
+// or rename wins.
+func (s *Set) Add(path string, op Op) {
+	for i, f := range s.Files {
+		if f.Path != path {
+			continue
+		}
+		s.Files[i].Op = fold(f.Op, op)
+		return
+	}
+	s.Files = append(s.Files, File{Path: path, Op: op})
+}
+
+func fold(prev, next Op) Op {
+	switch {
+	case prev == OpCreate && (next == OpWrite || next == OpChmod):
+		return OpCreate
+	case prev == OpWrite && next == OpChmod:
+		return OpWrite
+	case prev == OpRemove && next == OpCreate:
+		return OpWrite
+	default:
+		return next
+	}
+}
+
+// Merge combines two sets, e.g. when a rebuild request is still pending.
+func (s Set) Merge(other Set) Set {
+	merged := Set{
+		Detected: s.Detected,
+		Fired:    s.Fired,
+		Files:    append([]File(nil), s.Files...),
+		Reason:   s.Reason,
+	}
+	if merged.Detected.IsZero() || (!other.Detected.IsZero() && other.Detected.Before(merged.Detected)) {
+		merged.Detected = other.Detected
+	}
+	if other.Fired.After(merged.Fired) {
+		merged.Fired = other.Fired
+	}
+	for _, f := range other.Files {
+		merged.Add(f.Path, f.Op)
+	}
+	if other.Reason != "" && other.Reason != merged.Reason {
+		if merged.Reason != "" {
+			merged.Reason += ", "
+		}
+		merged.Reason += other.Reason
+	}
+	return merged
+}
+
+// Paths returns the changed paths in the order they were first seen.
+func (s Set) Paths() []string {
+	paths := make([]string, len(s.Files))
+	for i, f := range s.Files {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+// Relative returns a copy with paths relative to root and sorted, for
+// display and for clients outside the host.
+func (s Set) Relative(root string) Set {
+	rel := s
+	rel.Files = make([]File, len(s.Files))
+	for i, f := range s.Files {
+		if r, err := filepath.Rel(root, f.Path); err == nil && !strings.HasPrefix(r, "..") {
+			f.Path = filepath.ToSlash(r)
+		}
+		rel.Files[i] = f
+	}
+	sort.Slice(rel.Files, func(i, j int) bool { return rel.Files[i].Path < rel.Files[j].Path })
+	return rel
+}
+
+// Lines renders the set for the rebuild banner, one file per line, listing
+// at most limit files.
+func (s Set) Lines(limit int) []string {
+	var lines []string
+	switch n := len(s.Files); {
+	case n == 0 && s.Reason != "":
+		return []string{s.Reason}
+	case n == 0:
+		return nil
+	case n == 1:
+		lines = append(lines, "1 file changed:")
+	default:
+		lines = append(lines, fmt.Sprintf("%d files changed:", n))
+	}
+	for i, f := range s.Files {
+		if limit > 0 && i == limit {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(s.Files)-limit))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("  %-7s %s", f.Op, f.Path))
+	}
+	if s.Reason != "" && len(s.Files) > 0 {
+		lines = append(lines, s.Reason)
+	}
+	return lines
+}
+
+// Send queues set on ch without blocking. A set already waiting in ch is
+// merged into the new one so no change is lost. ch must be buffered.
+func Send(ch chan Set, set Set) {
+	for {
+		select {
+		case ch <- set:
+			return
+		default:
+		}
+		select {
+		case pending := <-ch:
+			set = pending.Merge(set)
+		default:
+		}
+	}
+}
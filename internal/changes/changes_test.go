@@ -0,0 +1,94 @@
+package changes
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddFoldsOperations(t *testing.T) {
+	var s Set
+	s.Add("/app/new.go", OpCreate)
+	s.Add("/app/new.go", OpWrite)
+	s.Add("/app/main.go", OpWrite)
+	s.Add("/app/main.go", OpChmod)
+	s.Add("/app/old.go", OpWrite)
+	s.Add("/app/old.go", OpRemove)
+	s.Add("/app/swap.go", OpRemove)
+	s.Add("/app/swap.go", OpCreate)
+
+	want := []File{
+		{Path: "/app/new.go", Op: OpCreate},
+		{Path: "/app/main.go", Op: OpWrite},
+		{Path: "/app/old.go", Op: OpRemove},
+		{Path: "/app/swap.go", Op: OpWrite},
+	}
+	if len(s.Files) != len(want) {
+		t.Fatalf("expected %d files, got %v", len(want), s.Files)
+	}
+	for i := range want {
+		if s.Files[i] != want[i] {
+			t.Fatalf("file %d: expected %+v, got %+v", i, want[i], s.Files[i])
+		}
+	}
+}
+
+func TestMergeKeepsEarliestDetectionAndLatestFire(t *testing.T) {
+	base := time.Now()
+	a := Set{Detected: base, Fired: base.Add(500 * time.Millisecond)}
+	a.Add("/app/a.go", OpWrite)
+	b := Set{Detected: base.Add(time.Second), Fired: base.Add(1500 * time.Millisecond), Reason: "templ output changed"}
+	b.Add("/app/a.go", OpRemove)
+	b.Add("/app/b.go", OpCreate)
+
+	m := a.Merge(b)
+	if !m.Detected.Equal(a.Detected) || !m.Fired.Equal(b.Fired) {
+		t.Fatalf("unexpected times: detected %v fired %v", m.Detected, m.Fired)
+	}
+	if strings.Join(m.Paths(), ",") != "/app/a.go,/app/b.go" || m.Files[0].Op != OpRemove {
+		t.Fatalf("unexpected files: %v", m.Files)
+	}
+	if m.Reason != "templ output changed" {
+		t.Fatalf("unexpected reason: %q", m.Reason)
+	}
+	if len(a.Files) != 1 || a.Files[0].Op != OpWrite {
+		t.Fatal("Merge must not modify the receiver")
+	}
+}
+
+func TestSendMergesPendingSet(t *testing.T) {
+	ch := make(chan Set, 1)
+
+	var first, second Set
+	first.Add("/app/a.go", OpWrite)
+	second.Add("/app/b.go", OpWrite)
+	Send(ch, first)
+	Send(ch, second)
+
+	got := <-ch
+	if strings.Join(got.Paths(), ",") != "/app/a.go,/app/b.go" {
+		t.Fatalf("expected merged set, got %v", got.Files)
+	}
+}
+
+func TestRelativeAndLines(t *testing.T) {
+	var s Set
+	s.Add("/app/internal/db/users.go", OpWrite)
+	s.Add("/app/go.mod", OpWrite)
+	s.Add("/app/cmd/app/main.go", OpCreate)
+
+	lines := s.Relative("/app").Lines(2)
+	want := []string{
+		"3 files changed:",
+		"  create  cmd/app/main.go",
+		"  write   go.mod",
+		"  ... and 1 more",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected lines:\n%s", strings.Join(lines, "\n"))
+	}
+
+	if got := (Set{Reason: "templ output changed"}).Lines(10); len(got) != 1 || got[0] != "templ output changed" {
+		t.Fatalf("unexpected lines for reason-only set: %v", got)
+	}
+}
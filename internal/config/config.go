@@ -0,0 +1,598 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// FileName is the optional project-level shadowfax configuration file.
+const FileName = "shadowfax.json"
+
+// Process targets that accept environment overrides.
+const (
+	TargetApp        = "app"
+	TargetTempl      = "templ"
+	TargetTailwind   = "tailwind"
+	TargetNpm        = "npm"
+	TargetAssets     = "assets"
+	TargetRules      = "rules"
+	TargetMigrations = "migrations"
+)
+
+var targets = map[string]bool{
+	TargetApp: true, TargetTempl: true, TargetTailwind: true, TargetNpm: true, TargetAssets: true,
+	TargetRules: true, TargetMigrations: true,
+}
+
+type Config struct {
+	// TemplDevMode controls TEMPL_DEV_MODE for the app process. Defaults to
+	// true; turn it off for production-like runs.
+	TemplDevMode *bool `json:"templDevMode,omitempty"`
+
+	// Env holds extra environment variables per process target.
+	Env map[string]map[string]EnvValue `json:"env,omitempty"`
+
+	Watch WatchConfig `json:"watch"`
+
+	Templ TemplConfig `json:"templ"`
+
+	Tailwind TailwindConfig `json:"tailwind"`
+
+	Assets AssetsConfig `json:"assets"`
+
+	Rules []Rule `json:"rules,omitempty"`
+
+	Migrations MigrationsConfig `json:"migrations"`
+
+	HTTPS HTTPSConfig `json:"https"`
+
+	HTTP2 HTTP2Config `json:"http2"`
+
+	Client ClientConfig `json:"client"`
+
+	Hold HoldConfig `json:"hold"`
+
+	dir string
+}
+
+// DefaultTailwindCLI is the Tailwind binary andurel projects download.
+const DefaultTailwindCLI = "bin/tailwindcli"
+
+// DefaultTailwindEntry is the stylesheet built when no entries are set.
+var DefaultTailwindEntry = TailwindEntry{
+	Name:   "style",
+	Input:  "css/base.css",
+	Output: "assets/css/style.css",
+}
+
+// TailwindConfig describes the Tailwind builds. Setting entries enables
+// Tailwind even without an andurel.lock.
+type TailwindConfig struct {
+	// CLI is the Tailwind binary, relative to the project root.
+	CLI     string          `json:"cli,omitempty"`
+	Entries []TailwindEntry `json:"entries,omitempty"`
+}
+
+// TailwindEntry is one input/output stylesheet pair.
+type TailwindEntry struct {
+	// Name labels the entry in logs. Defaults to the output file name
+	// without extension.
+	Name   string `json:"name,omitempty"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Minify bool   `json:"minify,omitempty"`
+}
+
+// TailwindCLI returns the configured Tailwind binary.
+func (t TailwindConfig) TailwindCLI() string {
+	if t.CLI == "" {
+		return DefaultTailwindCLI
+	}
+	return t.CLI
+}
+
+// TailwindEntries returns the configured entries, or the default one.
+func (t TailwindConfig) TailwindEntries() []TailwindEntry {
+	if len(t.Entries) == 0 {
+		return []TailwindEntry{DefaultTailwindEntry}
+	}
+	return t.Entries
+}
+
+// Asset reload modes.
+const (
+	AssetsReloadPage = "page"
+	AssetsReloadJS   = "js"
+)
+
+// DefaultAssetsSource is watched by one-shot asset builds without sources.
+const DefaultAssetsSource = "assets/js"
+
+// AssetsConfig describes the optional bundler stage for assets/. It is
+// enabled by setting Command.
+type AssetsConfig struct {
+	// Command is run through sh -c from the project root.
+	Command string `json:"command,omitempty"`
+	// Watch means Command watches by itself and keeps running, and each
+	// output line matching Done marks a finished build and each line
+	// matching Error a failed one. Otherwise Command is a one-shot build run
+	// whenever a file under Sources changes.
+	Watch bool   `json:"watch,omitempty"`
+	Done  string `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Sources are the directories watched for one-shot builds.
+	Sources []string `json:"sources,omitempty"`
+	// Exclude holds doublestar patterns, relative to the project root, that
+	// don't trigger one-shot builds, such as the bundler's output.
+	Exclude []string `json:"exclude,omitempty"`
+	// Reload is AssetsReloadPage (the default) or AssetsReloadJS.
+	Reload string `json:"reload,omitempty"`
+}
+
+// AssetsSources returns the configured sources, or the default one.
+func (a AssetsConfig) AssetsSources() []string {
+	if len(a.Sources) == 0 {
+		return []string{DefaultAssetsSource}
+	}
+	return a.Sources
+}
+
+// DefaultMigrationsDir is where andurel projects keep their migrations.
+const DefaultMigrationsDir = "database/migrations"
+
+// MigrationsConfig describes the migration stage run before the app starts.
+// It is enabled by setting Command.
+type MigrationsConfig struct {
+	// Dir is watched for new and changed migrations. Defaults to
+	// DefaultMigrationsDir.
+	Dir string `json:"dir,omitempty"`
+	// Command applies the pending migrations. It is run through sh -c from
+	// the project root.
+	Command string `json:"command,omitempty"`
+	// Status prints the migration status at startup. Optional.
+	Status string `json:"status,omitempty"`
+}
+
+// MigrationsDir returns the configured directory, or the default one.
+func (m MigrationsConfig) MigrationsDir() string {
+	if m.Dir == "" {
+		return DefaultMigrationsDir
+	}
+	return filepath.Clean(m.Dir)
+}
+
+// HTTPSConfig serves the proxy over TLS with a certificate from the local
+// CA.
+type HTTPSConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Hosts are extra hostnames and IP addresses for the certificate, on top
+	// of localhost, 127.0.0.1 and ::1.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// HTTP2Config selects where the proxy speaks HTTP/2.
+type HTTP2Config struct {
+	// Browser serves HTTP/2 to the browser, negotiated over HTTPS or as
+	// prior-knowledge h2c over plain HTTP. HTTP/1.1 stays available.
+	// Defaults to true.
+	Browser *bool `json:"browser,omitempty"`
+	// Upstream talks h2c to the app, which must accept HTTP/2 over
+	// cleartext. Upgrade requests still use HTTP/1.1.
+	Upstream bool `json:"upstream,omitempty"`
+}
+
+// ClientConfig controls how the reload client is injected into pages.
+type ClientConfig struct {
+	// Inline injects the whole client into every page instead of a script
+	// tag loading /__shadowfax/client.js.
+	Inline bool `json:"inline,omitempty"`
+}
+
+// Hold defaults.
+const (
+	DefaultHoldMaxWait = 30 * time.Second
+	DefaultHoldMaxBody = 10 << 20
+)
+
+// HoldConfig makes the proxy hold requests that arrive while the app is
+// restarting and forward them once it is healthy, instead of failing them.
+type HoldConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// MaxWait bounds how long a request is held. Defaults to
+	// DefaultHoldMaxWait.
+	MaxWait string `json:"maxWait,omitempty"`
+	// MaxBody is the largest request body, in bytes, that is held. Bodies
+	// aren't buffered ahead; only what a failed attempt read is kept for
+	// the replay. Defaults to DefaultHoldMaxBody.
+	MaxBody int64 `json:"maxBody,omitempty"`
+}
+
+// MaxWaitDuration returns MaxWait, or DefaultHoldMaxWait.
+func (h HoldConfig) MaxWaitDuration() time.Duration {
+	if d, err := time.ParseDuration(h.MaxWait); err == nil && d > 0 {
+		return d
+	}
+	return DefaultHoldMaxWait
+}
+
+// MaxBodyBytes returns MaxBody, or DefaultHoldMaxBody.
+func (h HoldConfig) MaxBodyBytes() int64 {
+	if h.MaxBody > 0 {
+		return h.MaxBody
+	}
+	return DefaultHoldMaxBody
+}
+
+// UseBrowser reports whether HTTP/2 is served to the browser.
+func (h HTTP2Config) UseBrowser() bool {
+	return h.Browser == nil || *h.Browser
+}
+
+// Rule actions.
+const (
+	RuleActionNone    = "none"
+	RuleActionReload  = "reload"
+	RuleActionCSS     = "css"
+	RuleActionRestart = "restart"
+	RuleActionRebuild = "rebuild"
+)
+
+var ruleActions = map[string]bool{
+	"": true, RuleActionNone: true, RuleActionReload: true, RuleActionCSS: true,
+	RuleActionRestart: true, RuleActionRebuild: true,
+}
+
+// DefaultRuleDebounce is how long a rule waits for more changes.
+const DefaultRuleDebounce = 200 * time.Millisecond
+
+// Rule runs a command when files matching its patterns change, then applies
+// its action.
+type Rule struct {
+	Name string `json:"name"`
+	// Match holds doublestar patterns relative to the project root.
+	Match []string `json:"match"`
+	// Run is run through sh -c from the project root. Optional.
+	Run string `json:"run,omitempty"`
+	// Action is one of the RuleAction values. Defaults to RuleActionNone.
+	Action   string `json:"action,omitempty"`
+	Debounce string `json:"debounce,omitempty"`
+}
+
+// DebounceDuration returns the rule's debounce, or DefaultRuleDebounce.
+func (r Rule) DebounceDuration() time.Duration {
+	if d, err := time.ParseDuration(r.Debounce); err == nil && d > 0 {
+		return d
+	}
+	return DefaultRuleDebounce
+}
+
+// Templ generation modes.
+const (
+	TemplModeAuto       = "auto"
+	TemplModeInProcess  = "inprocess"
+	TemplModeSubprocess = "subprocess"
+)
+
+// TemplConfig selects how templ generate runs.
+type TemplConfig struct {
+	// Mode is "auto" (default), "inprocess" or "subprocess". Auto runs the
+	// generator in-process when its version matches go.mod and no templ
+	// env overrides are set, and falls back to bin/templ otherwise.
+	Mode string `json:"mode,omitempty"`
+	// StrictVersion refuses to start when the templ generator and the templ
+	// version in go.mod differ. By default a mismatch is only a warning.
+	StrictVersion bool `json:"strictVersion,omitempty"`
+}
+
+// WatchConfig selects the directories and files the Go watcher follows.
+// Patterns use doublestar syntax relative to the project root.
+type WatchConfig struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Gitignore honors .gitignore files. Defaults to true.
+	Gitignore *bool `json:"gitignore,omitempty"`
+	// Backend is "auto" (default), "fsnotify" or "poll".
+	Backend string `json:"backend,omitempty"`
+	// PollInterval is a Go duration such as "1s". Only used when polling.
+	PollInterval string `json:"pollInterval,omitempty"`
+}
+
+var watchBackends = map[string]bool{"": true, "auto": true, "fsnotify": true, "poll": true}
+
+// Interval returns the parsed poll interval, or zero for the default.
+func (w WatchConfig) Interval() time.Duration {
+	d, _ := time.ParseDuration(w.PollInterval)
+	return d
+}
+
+// UseGitignore reports whether .gitignore files are honored.
+func (w WatchConfig) UseGitignore() bool {
+	return w.Gitignore == nil || *w.Gitignore
+}
+
+// EnvValue is either a literal (templated) string or a reference to a file
+// whose contents become the value:
+//
+//	"LOG_LEVEL": "debug"
+//	"APP_URL": "http://localhost:{{.ProxyPort}}"
+//	"DATABASE_URL": {"file": "secrets/database_url"}
+type EnvValue struct {
+	Value string `json:"value,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+func (v *EnvValue) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &v.Value)
+	}
+	type plain EnvValue
+	var p plain
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return err
+	}
+	if (p.Value == "") == (p.File == "") {
+		return errors.New(`env value needs exactly one of "value" or "file"`)
+	}
+	*v = EnvValue(p)
+	return nil
+}
+
+// EnvData is available to templated env values.
+type EnvData struct {
+	AppPort    string
+	ProxyPort  string
+	BuildID    string
+	ProjectDir string
+}
+
+// Load reads shadowfax.json from dir. A missing file yields the defaults.
+func Load(dir string) (*Config, error) {
+	cfg := &Config{dir: dir}
+
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", FileName, err)
+	}
+
+	for target := range cfg.Env {
+		if !targets[target] {
+			return nil, fmt.Errorf("parsing %s: unknown env target %q", FileName, target)
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, cfg.Watch.Include...), cfg.Watch.Exclude...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, fmt.Errorf("parsing %s: invalid watch pattern %q", FileName, pattern)
+		}
+	}
+
+	switch cfg.Templ.Mode {
+	case "", TemplModeAuto, TemplModeInProcess, TemplModeSubprocess:
+	default:
+		return nil, fmt.Errorf("parsing %s: unknown templ mode %q", FileName, cfg.Templ.Mode)
+	}
+
+	switch cfg.Assets.Reload {
+	case "", AssetsReloadPage, AssetsReloadJS:
+	default:
+		return nil, fmt.Errorf("parsing %s: unknown assets reload %q", FileName, cfg.Assets.Reload)
+	}
+	if cfg.Assets.Done != "" {
+		if _, err := regexp.Compile(cfg.Assets.Done); err != nil {
+			return nil, fmt.Errorf("parsing %s: invalid assets done pattern: %w", FileName, err)
+		}
+	}
+	if cfg.Assets.Error != "" {
+		if _, err := regexp.Compile(cfg.Assets.Error); err != nil {
+			return nil, fmt.Errorf("parsing %s: invalid assets error pattern: %w", FileName, err)
+		}
+	}
+	for _, pattern := range cfg.Assets.Exclude {
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, fmt.Errorf("parsing %s: invalid assets exclude pattern %q", FileName, pattern)
+		}
+	}
+
+	for _, host := range cfg.HTTPS.Hosts {
+		if host == "" || strings.ContainsAny(host, "/: ") && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("parsing %s: invalid https host %q", FileName, host)
+		}
+	}
+
+	if cfg.Hold.MaxWait != "" {
+		if d, err := time.ParseDuration(cfg.Hold.MaxWait); err != nil || d <= 0 {
+			return nil, fmt.Errorf("parsing %s: invalid hold maxWait %q", FileName, cfg.Hold.MaxWait)
+		}
+	}
+	if cfg.Hold.MaxBody < 0 {
+		return nil, fmt.Errorf("parsing %s: invalid hold maxBody %d", FileName, cfg.Hold.MaxBody)
+	}
+
+	ruleNames := make(map[string]bool, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" || len(rule.Match) == 0 {
+			return nil, fmt.Errorf("parsing %s: rule %d needs a name and match patterns", FileName, i)
+		}
+		if ruleNames[rule.Name] {
+			return nil, fmt.Errorf("parsing %s: duplicate rule %q", FileName, rule.Name)
+		}
+		ruleNames[rule.Name] = true
+		for _, pattern := range rule.Match {
+			if !doublestar.ValidatePattern(pattern) {
+				return nil, fmt.Errorf("parsing %s: rule %q: invalid pattern %q", FileName, rule.Name, pattern)
+			}
+		}
+		if !ruleActions[rule.Action] {
+			return nil, fmt.Errorf("parsing %s: rule %q: unknown action %q", FileName, rule.Name, rule.Action)
+		}
+		if rule.Debounce != "" {
+			if d, err := time.ParseDuration(rule.Debounce); err != nil || d <= 0 {
+				return nil, fmt.Errorf("parsing %s: rule %q: invalid debounce %q", FileName, rule.Name, rule.Debounce)
+			}
+		}
+	}
+
+	names := make(map[string]bool, len(cfg.Tailwind.Entries))
+	for i := range cfg.Tailwind.Entries {
+		entry := &cfg.Tailwind.Entries[i]
+		if entry.Input == "" || entry.Output == "" {
+			return nil, fmt.Errorf("parsing %s: tailwind entry %d needs input and output", FileName, i)
+		}
+		if entry.Name == "" {
+			entry.Name = strings.TrimSuffix(filepath.Base(entry.Output), filepath.Ext(entry.Output))
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("parsing %s: duplicate tailwind entry %q", FileName, entry.Name)
+		}
+		names[entry.Name] = true
+	}
+
+	if !watchBackends[cfg.Watch.Backend] {
+		return nil, fmt.Errorf("parsing %s: unknown watch backend %q", FileName, cfg.Watch.Backend)
+	}
+	if cfg.Watch.PollInterval != "" {
+		if d, err := time.ParseDuration(cfg.Watch.PollInterval); err != nil || d <= 0 {
+			return nil, fmt.Errorf("parsing %s: invalid watch pollInterval %q", FileName, cfg.Watch.PollInterval)
+		}
+	}
+
+	return cfg, nil
+}
+
+// UseTemplDevMode reports whether the app runs with TEMPL_DEV_MODE=true. An
+// explicit TEMPL_DEV_MODE in the app env takes precedence.
+func (c *Config) UseTemplDevMode() bool {
+	if v, ok := c.Env[TargetApp]["TEMPL_DEV_MODE"]; ok && v.File == "" {
+		return v.Value == "true"
+	}
+	return c.TemplDevMode == nil || *c.TemplDevMode
+}
+
+// ResolveEnv returns the KEY=VALUE overrides for target, in key order. For
+// the app target this starts with TEMPL_DEV_MODE unless the user sets it.
+func (c *Config) ResolveEnv(target string, data EnvData) ([]string, error) {
+	if data.ProjectDir == "" {
+		data.ProjectDir = c.dir
+	}
+
+	values := c.Env[target]
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var env []string
+	if target == TargetApp {
+		if _, set := values["TEMPL_DEV_MODE"]; !set {
+			if c.UseTemplDevMode() {
+				env = append(env, "TEMPL_DEV_MODE=true")
+			} else {
+				// Blank it so a value inherited from the shell can't leak in.
+				env = append(env, "TEMPL_DEV_MODE=")
+			}
+		}
+	}
+
+	for _, key := range keys {
+		v := values[key]
+		var value string
+		if v.File != "" {
+			path := v.File
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(c.dir, path)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("env %s for %s: %w", key, target, err)
+			}
+			value = strings.TrimRight(string(content), "\r\n")
+		} else {
+			rendered, err := renderEnvTemplate(key, v.Value, data)
+			if err != nil {
+				return nil, fmt.Errorf("env %s for %s: %w", key, target, err)
+			}
+			value = rendered
+		}
+		env = append(env, key+"="+value)
+	}
+
+	return env, nil
+}
+
+func renderEnvTemplate(name, text string, data EnvData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// MergeEnv applies overrides on top of base, replacing existing keys.
+func MergeEnv(base, overrides []string) []string {
+	if len(overrides) == 0 {
+		return base
+	}
+	replaced := make(map[string]bool, len(overrides))
+	for _, kv := range overrides {
+		key, _, _ := strings.Cut(kv, "=")
+		replaced[key] = true
+	}
+	merged := make([]string, 0, len(base)+len(overrides))
+	for _, kv := range base {
+		key, _, _ := strings.Cut(kv, "=")
+		if !replaced[key] {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// DiffEnvKeys splits the keys in overrides into those that are new to base
+// and those that replace an existing value.
+func DiffEnvKeys(base, overrides []string) (added, overridden []string) {
+	existing := make(map[string]bool, len(base))
+	for _, kv := range base {
+		key, _, _ := strings.Cut(kv, "=")
+		existing[key] = true
+	}
+	for _, kv := range overrides {
+		key, _, _ := strings.Cut(kv, "=")
+		if existing[key] {
+			overridden = append(overridden, key)
+		} else {
+			added = append(added, key)
+		}
+	}
+	return added, overridden
+}
@@ -0,0 +1,326 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMissingFileUsesDefaults(t *testing.T) {
+	cfg, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if !cfg.UseTemplDevMode() {
+		t.Fatal("expected TEMPL_DEV_MODE to default to enabled")
+	}
+	env, err := cfg.ResolveEnv(TargetApp, EnvData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(env, " ") != "TEMPL_DEV_MODE=true" {
+		t.Fatalf("unexpected default app env: %v", env)
+	}
+}
+
+func TestResolveEnvStaticFileAndTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "db.secret"), []byte("postgres://local/app\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, dir, `{
+  "templDevMode": false,
+  "env": {
+    "app": {
+      "LOG_LEVEL": "debug",
+      "DATABASE_URL": {"file": "db.secret"},
+      "APP_URL": "http://localhost:{{.ProxyPort}}/?build={{.BuildID}}"
+    }
+  }
+}`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.UseTemplDevMode() {
+		t.Fatal("expected TEMPL_DEV_MODE to be disabled")
+	}
+
+	env, err := cfg.ResolveEnv(TargetApp, EnvData{ProxyPort: "3000", BuildID: "server_1"})
+	if err != nil {
+		t.Fatalf("ResolveEnv returned error: %v", err)
+	}
+	want := []string{
+		"TEMPL_DEV_MODE=",
+		"APP_URL=http://localhost:3000/?build=server_1",
+		"DATABASE_URL=postgres://local/app",
+		"LOG_LEVEL=debug",
+	}
+	if strings.Join(env, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("ResolveEnv() = %v, want %v", env, want)
+	}
+}
+
+func TestLoadRejectsUnknownTarget(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"env": {"worker": {"A": "b"}}}`)
+	if _, err := Load(dir); err == nil {
+		t.Fatal("expected error for unknown env target")
+	}
+}
+
+func TestLoadRejectsAmbiguousEnvValue(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"env": {"app": {"A": {"value": "x", "file": "y"}}}}`)
+	if _, err := Load(dir); err == nil {
+		t.Fatal("expected error when both value and file are set")
+	}
+}
+
+func TestMergeEnvAndDiff(t *testing.T) {
+	base := []string{"PATH=/bin", "PORT=8080"}
+	overrides := []string{"PORT=9000", "DEBUG=1"}
+
+	merged := MergeEnv(base, overrides)
+	if strings.Join(merged, " ") != "PATH=/bin PORT=9000 DEBUG=1" {
+		t.Fatalf("unexpected merged env: %v", merged)
+	}
+
+	added, overridden := DiffEnvKeys(base, overrides)
+	if strings.Join(added, ",") != "DEBUG" || strings.Join(overridden, ",") != "PORT" {
+		t.Fatalf("unexpected diff: added=%v overridden=%v", added, overridden)
+	}
+}
+
+func TestLoadWatchBackend(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"watch": {"backend": "poll", "pollInterval": "750ms"}}`)
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.Watch.Backend != "poll" || cfg.Watch.Interval() != 750*time.Millisecond {
+		t.Fatalf("unexpected watch config: %+v", cfg.Watch)
+	}
+
+	for _, content := range []string{
+		`{"watch": {"backend": "kqueue"}}`,
+		`{"watch": {"pollInterval": "soon"}}`,
+		`{"watch": {"pollInterval": "-1s"}}`,
+	} {
+		writeConfig(t, dir, content)
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
+
+func TestTemplModuleVersion(t *testing.T) {
+	dir := t.TempDir()
+	gomod := "module example.com/app\n\ngo 1.25\n\nrequire github.com/a-h/templ v0.3.960\n"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := TemplModuleVersion(dir); err != nil || v != "v0.3.960" {
+		t.Fatalf("TemplModuleVersion = %q, %v", v, err)
+	}
+
+	gomod += "\nreplace github.com/a-h/templ => github.com/a-h/templ v0.3.977\n"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := TemplModuleVersion(dir); err != nil || v != "v0.3.977" {
+		t.Fatalf("expected replace to win, got %q, %v", v, err)
+	}
+}
+
+func TestLoadRejectsUnknownTemplMode(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"templ": {"mode": "plugin"}}`)
+	if _, err := Load(dir); err == nil {
+		t.Fatal("expected error for unknown templ mode")
+	}
+}
+
+func TestLoadTailwindEntries(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"tailwind": {"entries": [
+  {"input": "css/base.css", "output": "assets/css/style.css"},
+  {"name": "admin", "input": "css/admin.css", "output": "assets/css/admin.css", "minify": true}
+]}}`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	entries := cfg.Tailwind.TailwindEntries()
+	if len(entries) != 2 || entries[0].Name != "style" || entries[1].Name != "admin" || !entries[1].Minify {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if cfg.Tailwind.TailwindCLI() != DefaultTailwindCLI {
+		t.Fatalf("expected default CLI, got %q", cfg.Tailwind.TailwindCLI())
+	}
+
+	for _, content := range []string{
+		`{"tailwind": {"entries": [{"input": "css/base.css"}]}}`,
+		`{"tailwind": {"entries": [{"input": "a.css", "output": "out/x.css"}, {"input": "b.css", "output": "other/x.css"}]}}`,
+	} {
+		writeConfig(t, dir, content)
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
+
+func TestLoadAssets(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"assets": {"command": "npx esbuild assets/js/app.js --bundle --outfile=assets/dist/app.js", "reload": "js", "exclude": ["assets/dist/**"]}}`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.Assets.Reload != AssetsReloadJS || cfg.Assets.AssetsSources()[0] != DefaultAssetsSource {
+		t.Fatalf("unexpected assets config: %+v", cfg.Assets)
+	}
+
+	for _, content := range []string{
+		`{"assets": {"reload": "hmr"}}`,
+		`{"assets": {"done": "("}}`,
+		`{"assets": {"error": "["}}`,
+	} {
+		writeConfig(t, dir, content)
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"migrations": {"command": "goose up", "status": "goose status"}}`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.Migrations.MigrationsDir() != DefaultMigrationsDir || cfg.Migrations.Status != "goose status" {
+		t.Fatalf("unexpected migrations config: %+v", cfg.Migrations)
+	}
+
+	writeConfig(t, dir, `{"migrations": {"dir": "db/migrations/", "command": "goose up"}}`)
+	if cfg, err = Load(dir); err != nil || cfg.Migrations.MigrationsDir() != "db/migrations" {
+		t.Fatalf("expected custom migrations dir, got %+v (err %v)", cfg, err)
+	}
+}
+
+func TestLoadHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"https": {"enabled": true, "hosts": ["app.test", "*.app.test", "192.168.1.20", "fe80::1"]}}`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if !cfg.HTTPS.Enabled || len(cfg.HTTPS.Hosts) != 4 {
+		t.Fatalf("unexpected https config: %+v", cfg.HTTPS)
+	}
+
+	for _, content := range []string{
+		`{"https": {"hosts": ["https://app.test"]}}`,
+		`{"https": {"hosts": ["app.test:3000"]}}`,
+		`{"https": {"hosts": [""]}}`,
+	} {
+		writeConfig(t, dir, content)
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
+
+func TestLoadHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if !cfg.HTTP2.UseBrowser() || cfg.HTTP2.Upstream {
+		t.Fatalf("expected HTTP/2 to the browser only by default, got %+v", cfg.HTTP2)
+	}
+
+	writeConfig(t, dir, `{"http2": {"browser": false, "upstream": true}}`)
+	if cfg, err = Load(dir); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.HTTP2.UseBrowser() || !cfg.HTTP2.Upstream {
+		t.Fatalf("unexpected http2 config: %+v", cfg.HTTP2)
+	}
+}
+
+func TestLoadHold(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.Hold.Enabled || cfg.Hold.MaxWaitDuration() != DefaultHoldMaxWait || cfg.Hold.MaxBodyBytes() != DefaultHoldMaxBody {
+		t.Fatalf("unexpected default hold config: %+v", cfg.Hold)
+	}
+
+	writeConfig(t, dir, `{"hold": {"enabled": true, "maxWait": "1m", "maxBody": 1024}}`)
+	if cfg, err = Load(dir); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if !cfg.Hold.Enabled || cfg.Hold.MaxWaitDuration() != time.Minute || cfg.Hold.MaxBodyBytes() != 1024 {
+		t.Fatalf("unexpected hold config: %+v", cfg.Hold)
+	}
+
+	for _, content := range []string{
+		`{"hold": {"maxWait": "soon"}}`,
+		`{"hold": {"maxBody": -1}}`,
+	} {
+		writeConfig(t, dir, content)
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, `{"rules": [
+  {"name": "i18n", "match": ["locales/**/*.json"], "run": "make i18n", "action": "reload"},
+  {"name": "sqlc", "match": ["db/queries/*.sql"], "run": "sqlc generate", "action": "rebuild", "debounce": "1s"}
+]}`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if len(cfg.Rules) != 2 || cfg.Rules[0].DebounceDuration() != DefaultRuleDebounce || cfg.Rules[1].DebounceDuration() != time.Second {
+		t.Fatalf("unexpected rules: %+v", cfg.Rules)
+	}
+
+	for _, content := range []string{
+		`{"rules": [{"name": "x"}]}`,
+		`{"rules": [{"name": "x", "match": ["a/**"]}, {"name": "x", "match": ["b/**"]}]}`,
+		`{"rules": [{"name": "x", "match": ["a/[**"]}]}`,
+		`{"rules": [{"name": "x", "match": ["a/**"], "action": "deploy"}]}`,
+		`{"rules": [{"name": "x", "match": ["a/**"], "debounce": "soon"}]}`,
+	} {
+		writeConfig(t, dir, content)
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
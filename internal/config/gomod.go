@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// TemplModulePath is the module path of the templ runtime.
+const TemplModulePath = "github.com/a-h/templ"
+
+// TemplModuleVersion returns the templ version required by the go.mod in
+// dir, honoring replace directives that pin a version. It returns "" when
+// the module doesn't depend on templ.
+func TemplModuleVersion(dir string) (string, error) {
+	path := filepath.Join(dir, "go.mod")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	mf, err := modfile.Parse(path, data, nil)
+	if err != nil {
+		return "", err
+	}
+
+	version := ""
+	for _, r := range mf.Require {
+		if r.Mod.Path == TemplModulePath {
+			version = r.Mod.Version
+		}
+	}
+	for _, r := range mf.Replace {
+		if r.Old.Path == TemplModulePath && r.New.Version != "" {
+			version = r.New.Version
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,288 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/reload"
+	"github.com/mbvlabs/shadowfax/internal/state"
+)
+
+// Action says how shadowfax should react to an Event.
+type Action int8
+
+const (
+	// ActionRebuild rebuilds and restarts the app.
+	ActionRebuild Action = iota
+	// ActionRestart rebuilds for generated Go code, unless the source
+	// currently reports errors.
+	ActionRestart
+	// ActionRestartApp restarts the running build without rebuilding.
+	ActionRestartApp
+	// ActionReloadPage reloads the browser.
+	ActionReloadPage
+	// ActionReloadCSS swaps the stylesheets listed in the event's paths.
+	ActionReloadCSS
+	// ActionReloadJS announces rebuilt scripts to the page.
+	ActionReloadJS
+	// ActionError sets the source's error message.
+	ActionError
+	// ActionErrorCleared clears the source's error message.
+	ActionErrorCleared
+)
+
+var actionNames = [...]string{"rebuild", "restart", "restart-app", "reload-page", "reload-css", "reload-js", "error", "error-cleared"}
+
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return fmt.Sprintf("action(%d)", a)
+}
+
+// Event is something a watcher wants shadowfax to act on.
+type Event struct {
+	// Source is the name of the watcher that sent the event.
+	Source string
+	Action Action
+	// Changes holds the changed paths, relative to the project root. The
+	// timings of rebuild and restart sets feed the build metrics.
+	Changes changes.Set
+	// Message is the error text of ActionError.
+	Message string
+}
+
+// Paths returns the changed paths of the event.
+func (e Event) Paths() []string {
+	return e.Changes.Paths()
+}
+
+// Watcher is a source of events. Run blocks until ctx is done, returning
+// nil, or until the watcher fails.
+type Watcher interface {
+	Name() string
+	Run(ctx context.Context, events chan<- Event) error
+}
+
+// Follower is implemented by watchers whose output depends on the sources
+// of other watchers, like Tailwind scanning templates for class names.
+// Follow is called for page reloads and restarts from other watchers. It
+// returns true when the follower will send its own reload, in which case
+// the dispatcher turns that reload into the page reload it held back.
+type Follower interface {
+	Follow(ev Event) bool
+}
+
+// Func adapts a function to the Watcher interface.
+func Func(name string, run func(ctx context.Context, events chan<- Event) error) Watcher {
+	return funcWatcher{name: name, run: run}
+}
+
+type funcWatcher struct {
+	name string
+	run  func(ctx context.Context, events chan<- Event) error
+}
+
+func (f funcWatcher) Name() string { return f.name }
+
+func (f funcWatcher) Run(ctx context.Context, events chan<- Event) error {
+	return f.run(ctx, events)
+}
+
+// Emit sends ev unless ctx is done first.
+func Emit(ctx context.Context, events chan<- Event, ev Event) {
+	select {
+	case events <- ev:
+	case <-ctx.Done():
+	}
+}
+
+type Config struct {
+	Verbose     bool
+	Broadcaster *reload.Broadcaster
+	Tracker     *state.Tracker
+	// Rebuild receives the change sets of rebuild and restart events.
+	Rebuild chan changes.Set
+	// Restart restarts the running build for restart-app events. Without
+	// it they rebuild.
+	Restart func(changes.Set)
+	// RebuildInProgress holds back browser reloads while the app restarts,
+	// since the restart reloads the page anyway.
+	RebuildInProgress *atomic.Bool
+	// Ready is signaled once a restarted app is healthy, which ends the
+	// rebuild.
+	Ready     <-chan struct{}
+	ClearLogs func()
+}
+
+// Dispatcher runs a set of watchers and routes their events.
+type Dispatcher struct {
+	cfg      Config
+	watchers []Watcher
+
+	// pending holds the followers whose next reload replaces a page reload
+	// held back for them.
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func New(cfg Config, watchers ...Watcher) *Dispatcher {
+	if cfg.RebuildInProgress == nil {
+		cfg.RebuildInProgress = new(atomic.Bool)
+	}
+	return &Dispatcher{cfg: cfg, watchers: watchers, pending: make(map[string]bool)}
+}
+
+// Run starts every watcher and routes their events until all of them have
+// returned. The first watcher error stops the others and is returned.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan Event, 16)
+	errs := make(chan error, len(d.watchers))
+	for _, w := range d.watchers {
+		go func() {
+			if err := w.Run(ctx, events); err != nil {
+				errs <- fmt.Errorf("%s: %w", w.Name(), err)
+				return
+			}
+			errs <- nil
+		}()
+	}
+
+	var first error
+	for running := len(d.watchers); running > 0; {
+		select {
+		case ev := <-events:
+			d.Handle(ev)
+		case <-d.cfg.Ready:
+			d.cfg.RebuildInProgress.Store(false)
+		case err := <-errs:
+			running--
+			if err != nil && first == nil {
+				first = err
+				cancel()
+			}
+		}
+	}
+	return first
+}
+
+// Handle routes a single event.
+func (d *Dispatcher) Handle(ev Event) {
+	if d.cfg.Verbose {
+		fmt.Printf("[shadowfax] %s: %s %v\n", ev.Source, ev.Action, ev.Paths())
+	}
+
+	switch ev.Action {
+	case ActionRebuild, ActionRestart:
+		if ev.Action == ActionRestart {
+			if d.hasError(ev.Source) {
+				fmt.Printf("[shadowfax] %s has errors, skipping rebuild\n", ev.Source)
+				return
+			}
+			fmt.Printf("[shadowfax] %s output changed, rebuilding\n", ev.Source)
+			d.follow(ev)
+		}
+		d.cfg.RebuildInProgress.Store(true)
+		changes.Send(d.cfg.Rebuild, ev.Changes)
+
+	case ActionRestartApp:
+		d.cfg.RebuildInProgress.Store(true)
+		if d.cfg.Restart == nil {
+			changes.Send(d.cfg.Rebuild, ev.Changes)
+			return
+		}
+		d.cfg.Restart(ev.Changes)
+
+	case ActionReloadPage:
+		if d.cfg.ClearLogs != nil {
+			d.cfg.ClearLogs()
+		}
+		if d.hasError(ev.Source) {
+			fmt.Printf("[shadowfax] %s has errors, skipping browser reload\n", ev.Source)
+			return
+		}
+		if d.follow(ev) {
+			return
+		}
+		d.reloadPage(ev)
+
+	case ActionReloadCSS, ActionReloadJS:
+		if d.cfg.RebuildInProgress.Load() {
+			if d.cfg.Verbose {
+				fmt.Printf("[shadowfax] %s rebuilt (server restart in progress, skipping broadcast)\n", ev.Source)
+			}
+			return
+		}
+		if d.takePending(ev.Source) {
+			d.reloadPage(ev)
+			return
+		}
+		if ev.Action == ActionReloadCSS {
+			name := ev.Changes.Reason
+			if name == "" {
+				name = ev.Source
+			}
+			fmt.Printf("[shadowfax] CSS rebuilt (%s), swapping stylesheet\n", name)
+			d.cfg.Broadcaster.Notify(reload.CSSMessage(ev.Paths()))
+		} else {
+			fmt.Printf("[shadowfax] %s rebuilt, notifying page\n", ev.Source)
+			d.cfg.Broadcaster.Notify(reload.JSMessage(ev.Paths()))
+		}
+
+	case ActionError:
+		d.cfg.Tracker.SetError(d.cfg.Tracker.Index(ev.Source), ev.Message)
+	case ActionErrorCleared:
+		d.cfg.Tracker.SetError(d.cfg.Tracker.Index(ev.Source), "")
+	}
+}
+
+func (d *Dispatcher) reloadPage(ev Event) {
+	if d.cfg.RebuildInProgress.Load() {
+		if d.cfg.Verbose {
+			fmt.Printf("[shadowfax] %s changed (server restart in progress, skipping broadcast)\n", ev.Source)
+		}
+		return
+	}
+	fmt.Printf("[shadowfax] %s changed, reloading browser\n", ev.Source)
+	d.cfg.Broadcaster.Broadcast()
+}
+
+// follow passes ev to the other watchers that follow it and reports whether
+// one of them will send the reload.
+func (d *Dispatcher) follow(ev Event) bool {
+	followed := false
+	for _, w := range d.watchers {
+		f, ok := w.(Follower)
+		if !ok || w.Name() == ev.Source || !f.Follow(ev) {
+			continue
+		}
+		followed = true
+		if ev.Action == ActionReloadPage {
+			fmt.Printf("[shadowfax] %s changed, waiting for %s\n", ev.Source, w.Name())
+			d.mu.Lock()
+			d.pending[w.Name()] = true
+			d.mu.Unlock()
+		}
+	}
+	return followed
+}
+
+func (d *Dispatcher) takePending(source string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.pending[source] {
+		return false
+	}
+	delete(d.pending, source)
+	return true
+}
+
+func (d *Dispatcher) hasError(source string) bool {
+	return d.cfg.Tracker.HasErrorAt(d.cfg.Tracker.Index(source))
+}
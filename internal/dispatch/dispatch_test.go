@@ -0,0 +1,273 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/reload"
+	"github.com/mbvlabs/shadowfax/internal/state"
+)
+
+type fakeFollower struct {
+	name    string
+	follows bool
+	calls   int
+}
+
+func (f *fakeFollower) Name() string { return f.name }
+
+func (f *fakeFollower) Run(ctx context.Context, _ chan<- Event) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeFollower) Follow(Event) bool {
+	f.calls++
+	return f.follows
+}
+
+func newTestDispatcher(t *testing.T, watchers ...Watcher) (*Dispatcher, chan reload.Message, chan changes.Set) {
+	t.Helper()
+	b := reload.NewBroadcaster()
+	listener := b.Subscribe()
+	t.Cleanup(func() { b.Unsubscribe(listener) })
+	rebuild := make(chan changes.Set, 1)
+	d := New(Config{Broadcaster: b, Tracker: state.New(), Rebuild: rebuild}, watchers...)
+	return d, listener, rebuild
+}
+
+func expectMessage(t *testing.T, listener chan reload.Message) reload.Message {
+	t.Helper()
+	select {
+	case msg := <-listener:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("expected a browser message")
+		return ""
+	}
+}
+
+func expectNoMessage(t *testing.T, listener chan reload.Message) {
+	t.Helper()
+	select {
+	case msg := <-listener:
+		t.Fatalf("unexpected browser message %q", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func cssEvent(source, output string) Event {
+	set := changes.Set{Reason: "style"}
+	set.Add(output, changes.OpWrite)
+	return Event{Source: source, Action: ActionReloadCSS, Changes: set}
+}
+
+func TestCSSRebuildSwapsStylesheetWhenIdle(t *testing.T) {
+	d, listener, _ := newTestDispatcher(t)
+
+	d.Handle(cssEvent("tailwind", "assets/css/style.css"))
+
+	if msg := expectMessage(t, listener); msg != reload.CSSMessage([]string{"assets/css/style.css"}) {
+		t.Fatalf("expected css message, got %q", msg)
+	}
+}
+
+func TestCSSRebuildSuppressedDuringRestart(t *testing.T) {
+	d, listener, _ := newTestDispatcher(t)
+	d.cfg.RebuildInProgress.Store(true)
+
+	d.Handle(cssEvent("tailwind", "assets/css/style.css"))
+	expectNoMessage(t, listener)
+}
+
+func TestReadyClearsRebuildInProgress(t *testing.T) {
+	ready := make(chan struct{}, 1)
+	d, _, _ := newTestDispatcher(t, Func("waiter", func(ctx context.Context, _ chan<- Event) error {
+		<-ctx.Done()
+		return nil
+	}))
+	d.cfg.Ready = ready
+	d.cfg.RebuildInProgress.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	ready <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for d.cfg.RebuildInProgress.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("RebuildInProgress should be cleared after the ready signal")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestFullRestartCycle follows a templ restart: the rebuild flag is set, a
+// CSS rebuild during the Go rebuild is held back, the ready signal clears
+// the flag and the next CSS rebuild is swapped in.
+func TestFullRestartCycle(t *testing.T) {
+	ready := make(chan struct{})
+	sent := make(chan Event)
+	source := Func("source", func(ctx context.Context, events chan<- Event) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ev := <-sent:
+				Emit(ctx, events, ev)
+			}
+		}
+	})
+	d, listener, rebuild := newTestDispatcher(t, source)
+	d.cfg.Ready = ready
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	sent <- Event{Source: "templ", Action: ActionRestart}
+	<-rebuild
+	if !d.cfg.RebuildInProgress.Load() {
+		t.Fatal("expected a restart to set RebuildInProgress")
+	}
+
+	sent <- cssEvent("tailwind", "assets/css/style.css")
+	expectNoMessage(t, listener)
+
+	ready <- struct{}{}
+	sent <- cssEvent("tailwind", "assets/css/style.css")
+	if msg := expectMessage(t, listener); msg != reload.CSSMessage([]string{"assets/css/style.css"}) {
+		t.Fatalf("expected the CSS rebuild after the restart to be swapped in, got %q", msg)
+	}
+}
+
+// A template change held back for a follower reloads the page once the
+// follower's CSS rebuild arrives; later CSS rebuilds are swapped again.
+func TestFollowerReloadReplacesHeldPageReload(t *testing.T) {
+	tailwind := &fakeFollower{name: "tailwind", follows: true}
+	d, listener, _ := newTestDispatcher(t, tailwind)
+
+	d.Handle(Event{Source: "templ", Action: ActionReloadPage})
+	expectNoMessage(t, listener)
+	if tailwind.calls != 1 {
+		t.Fatalf("expected follower to be called once, got %d", tailwind.calls)
+	}
+
+	d.Handle(cssEvent("tailwind", "assets/css/style.css"))
+	if msg := expectMessage(t, listener); msg != reload.MessageReload {
+		t.Fatalf("expected page reload, got %q", msg)
+	}
+
+	d.Handle(cssEvent("tailwind", "assets/css/style.css"))
+	if msg := expectMessage(t, listener); !strings.Contains(string(msg), `"type":"css"`) {
+		t.Fatalf("expected css message, got %q", msg)
+	}
+}
+
+func TestPageReloadWithoutFollowers(t *testing.T) {
+	d, listener, _ := newTestDispatcher(t, &fakeFollower{name: "tailwind"})
+
+	d.Handle(Event{Source: "templ", Action: ActionReloadPage})
+	if msg := expectMessage(t, listener); msg != reload.MessageReload {
+		t.Fatalf("expected page reload, got %q", msg)
+	}
+}
+
+func TestRestartSkippedWhileSourceHasErrors(t *testing.T) {
+	d, _, rebuild := newTestDispatcher(t)
+
+	d.Handle(Event{Source: "templ", Action: ActionError, Message: "parse error"})
+	d.Handle(Event{Source: "templ", Action: ActionRestart})
+	select {
+	case <-rebuild:
+		t.Fatal("restart should be skipped while templ has errors")
+	default:
+	}
+
+	d.Handle(Event{Source: "templ", Action: ActionErrorCleared})
+	set := changes.Set{}
+	set.Add("views/home_templ.go", changes.OpWrite)
+	d.Handle(Event{Source: "templ", Action: ActionRestart, Changes: set})
+	select {
+	case got := <-rebuild:
+		if len(got.Files) != 1 || got.Files[0].Path != "views/home_templ.go" {
+			t.Fatalf("unexpected rebuild set: %+v", got)
+		}
+	default:
+		t.Fatal("expected a rebuild after the error cleared")
+	}
+	if !d.cfg.RebuildInProgress.Load() {
+		t.Fatal("expected rebuild to be marked in progress")
+	}
+}
+
+func TestErrorEventsUpdateTracker(t *testing.T) {
+	d, _, _ := newTestDispatcher(t)
+
+	d.Handle(Event{Source: "lint", Action: ActionError, Message: "unused variable"})
+	if errs := d.cfg.Tracker.Errors(); len(errs) != 1 || errs[0].Source != "lint" {
+		t.Fatalf("unexpected errors: %+v", errs)
+	}
+	d.Handle(Event{Source: "lint", Action: ActionErrorCleared})
+	if d.cfg.Tracker.HasError() {
+		t.Fatal("expected error to be cleared")
+	}
+}
+
+func TestRunRoutesEventsAndStopsOnError(t *testing.T) {
+	var stopped atomic.Bool
+	sender := Func("custom", func(ctx context.Context, events chan<- Event) error {
+		Emit(ctx, events, Event{Source: "custom", Action: ActionRebuild, Changes: changes.Set{Reason: "custom"}})
+		return errors.New("boom")
+	})
+	waiter := Func("waiter", func(ctx context.Context, _ chan<- Event) error {
+		<-ctx.Done()
+		stopped.Store(true)
+		return nil
+	})
+	d, _, rebuild := newTestDispatcher(t, sender, waiter)
+
+	err := d.Run(context.Background())
+	if err == nil || err.Error() != "custom: boom" {
+		t.Fatalf("expected custom watcher error, got %v", err)
+	}
+	if !stopped.Load() {
+		t.Fatal("expected the other watchers to be stopped")
+	}
+	select {
+	case set := <-rebuild:
+		if set.Reason != "custom" {
+			t.Fatalf("unexpected rebuild set: %+v", set)
+		}
+	default:
+		t.Fatal("expected the custom watcher's rebuild to be routed")
+	}
+}
+
+func TestRestartAppUsesRestartHook(t *testing.T) {
+	d, _, rebuild := newTestDispatcher(t)
+	d.Handle(Event{Source: "rule:config", Action: ActionRestartApp})
+	select {
+	case <-rebuild:
+	default:
+		t.Fatal("expected a rebuild without a restart hook")
+	}
+
+	var restarted []changes.Set
+	d.cfg.Restart = func(set changes.Set) { restarted = append(restarted, set) }
+	d.Handle(Event{Source: "rule:config", Action: ActionRestartApp, Changes: changes.Set{Reason: "config"}})
+	if len(restarted) != 1 || restarted[0].Reason != "config" {
+		t.Fatalf("expected restart hook to be called, got %+v", restarted)
+	}
+	select {
+	case <-rebuild:
+		t.Fatal("restart-app should not rebuild when the hook is set")
+	default:
+	}
+}
@@ -0,0 +1,286 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+)
+
+// Stage names one step of a rebuild cycle.
+type Stage string
+
+const (
+	StageDebounce    Stage = "debounce"
+	StageBuild       Stage = "build"
+	StageBeforeStart Stage = "before-start"
+	StageStop        Stage = "stop"
+	StageStart       Stage = "start"
+	StageHealthy     Stage = "healthy"
+	StageBroadcast   Stage = "broadcast"
+	StageTotal       Stage = "total"
+)
+
+// Stages lists every stage in pipeline order.
+var Stages = []Stage{StageDebounce, StageBuild, StageBeforeStart, StageStop, StageStart, StageHealthy, StageBroadcast, StageTotal}
+
+const (
+	OutcomeOK          = "ok"
+	OutcomeBuildFailed = "build-failed"
+	OutcomeStartFailed = "start-failed"
+	OutcomeUnhealthy   = "unhealthy"
+	OutcomeCanceled    = "canceled"
+)
+
+// DefaultHistory is how many finished cycles a Recorder keeps.
+const DefaultHistory = 200
+
+// Cycle is the timing record of one change → reload loop.
+type Cycle struct {
+	ID             uint64
+	ChangeDetected time.Time
+	Changes        changes.Set
+	Stages         map[Stage]time.Duration
+	Outcome        string
+
+	rec  *Recorder
+	mu   sync.Mutex
+	done bool
+}
+
+// Recorder collects cycle timings and serves aggregated stats.
+type Recorder struct {
+	mu      sync.Mutex
+	limit   int
+	nextID  uint64
+	history []*Cycle
+
+	// Print writes the per-cycle summary line. Nil disables it.
+	Print func(string)
+}
+
+func NewRecorder(limit int) *Recorder {
+	if limit <= 0 {
+		limit = DefaultHistory
+	}
+	return &Recorder{
+		limit: limit,
+		Print: func(line string) { fmt.Println(line) },
+	}
+}
+
+// Begin starts a new cycle for the change set that triggered it. The
+// debounce stage is taken from the set's timestamps when present.
+func (r *Recorder) Begin(set changes.Set) *Cycle {
+	if r == nil {
+		return nil
+	}
+
+	c := &Cycle{
+		ChangeDetected: time.Now(),
+		Changes:        set,
+		Stages:         make(map[Stage]time.Duration),
+		rec:            r,
+	}
+	if !set.Detected.IsZero() {
+		c.ChangeDetected = set.Detected
+		if !set.Fired.IsZero() {
+			c.Stages[StageDebounce] = set.Fired.Sub(set.Detected)
+		}
+	}
+
+	r.mu.Lock()
+	r.nextID++
+	c.ID = r.nextID
+	r.mu.Unlock()
+
+	return c
+}
+
+// Observe records the duration of stage.
+func (c *Cycle) Observe(stage Stage, d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Stages[stage] = d
+}
+
+// Since records the time elapsed since start for stage.
+func (c *Cycle) Since(stage Stage, start time.Time) {
+	c.Observe(stage, time.Since(start))
+}
+
+// Finish closes the cycle with outcome and adds it to the history. Only the
+// first call has an effect.
+func (c *Cycle) Finish(outcome string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return
+	}
+	c.done = true
+	c.Outcome = outcome
+	c.Stages[StageTotal] = time.Since(c.ChangeDetected)
+	c.mu.Unlock()
+
+	r := c.rec
+	r.mu.Lock()
+	r.history = append(r.history, c)
+	if len(r.history) > r.limit {
+		r.history = r.history[len(r.history)-r.limit:]
+	}
+	printFn := r.Print
+	r.mu.Unlock()
+
+	if outcome == OutcomeOK && printFn != nil {
+		printFn(c.Summary())
+	}
+}
+
+// Summary renders the one-line timing report printed after each reload.
+func (c *Cycle) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var parts []string
+	for _, stage := range Stages {
+		if stage == StageTotal {
+			continue
+		}
+		if d, ok := c.Stages[stage]; ok {
+			parts = append(parts, fmt.Sprintf("%s %s", stage, formatDuration(d)))
+		}
+	}
+	return fmt.Sprintf("[shadowfax] Reloaded in %s (%s)", formatDuration(c.Stages[StageTotal]), strings.Join(parts, ", "))
+}
+
+// StageStats aggregates one stage over the recorded successful cycles.
+type StageStats struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50Ms"`
+	P95   float64 `json:"p95Ms"`
+	Last  float64 `json:"lastMs"`
+}
+
+// Stats is the payload served by /__shadowfax/stats.
+type Stats struct {
+	Cycles   int                  `json:"cycles"`
+	Outcomes map[string]int       `json:"outcomes"`
+	Stages   map[Stage]StageStats `json:"stages"`
+	Recent   []CycleJSON          `json:"recent"`
+}
+
+// CycleJSON is a cycle with durations rendered in milliseconds.
+type CycleJSON struct {
+	ID             uint64            `json:"id"`
+	ChangeDetected time.Time         `json:"changeDetected"`
+	Outcome        string            `json:"outcome"`
+	StagesMs       map[Stage]float64 `json:"stagesMs"`
+	Files          []changes.File    `json:"files,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+}
+
+const recentCycles = 20
+
+func (r *Recorder) Stats() Stats {
+	r.mu.Lock()
+	history := make([]*Cycle, len(r.history))
+	copy(history, r.history)
+	r.mu.Unlock()
+
+	stats := Stats{
+		Cycles:   len(history),
+		Outcomes: make(map[string]int),
+		Stages:   make(map[Stage]StageStats),
+	}
+
+	samples := make(map[Stage][]time.Duration)
+	for _, c := range history {
+		c.mu.Lock()
+		stats.Outcomes[c.Outcome]++
+		if c.Outcome == OutcomeOK {
+			for stage, d := range c.Stages {
+				samples[stage] = append(samples[stage], d)
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	for stage, ds := range samples {
+		last := ds[len(ds)-1]
+		sorted := append([]time.Duration(nil), ds...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats.Stages[stage] = StageStats{
+			Count: len(sorted),
+			P50:   ms(percentile(sorted, 50)),
+			P95:   ms(percentile(sorted, 95)),
+			Last:  ms(last),
+		}
+	}
+
+	start := max(len(history)-recentCycles, 0)
+	for _, c := range history[start:] {
+		c.mu.Lock()
+		cj := CycleJSON{
+			ID:             c.ID,
+			ChangeDetected: c.ChangeDetected,
+			Outcome:        c.Outcome,
+			StagesMs:       make(map[Stage]float64, len(c.Stages)),
+			Files:          c.Changes.Files,
+			Reason:         c.Changes.Reason,
+		}
+		for stage, d := range c.Stages {
+			cj.StagesMs[stage] = ms(d)
+		}
+		c.mu.Unlock()
+		stats.Recent = append(stats.Recent, cj)
+	}
+
+	return stats
+}
+
+// ServeHTTP serves the aggregated stats as JSON.
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(r.Stats())
+}
+
+// percentile uses the nearest-rank method on an ascending slice.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	default:
+		return fmt.Sprintf("%dµs", d.Microseconds())
+	}
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+)
+
+func TestBeginUsesChangeSetTimes(t *testing.T) {
+	r := NewRecorder(10)
+	detected := time.Now().Add(-time.Second)
+	set := changes.Set{Detected: detected, Fired: detected.Add(500 * time.Millisecond)}
+	set.Add("/app/main.go", changes.OpWrite)
+
+	c := r.Begin(set)
+	if !c.ChangeDetected.Equal(detected) {
+		t.Fatalf("expected change time %v, got %v", detected, c.ChangeDetected)
+	}
+	if got := c.Stages[StageDebounce]; got != 500*time.Millisecond {
+		t.Fatalf("expected 500ms debounce, got %s", got)
+	}
+
+	rollback := r.Begin(changes.Set{})
+	if _, ok := rollback.Stages[StageDebounce]; ok {
+		t.Fatal("a cycle without a change set should have no debounce stage")
+	}
+}
+
+func TestFinishPrintsSummaryOnlyOnSuccess(t *testing.T) {
+	r := NewRecorder(10)
+	var lines []string
+	r.Print = func(line string) { lines = append(lines, line) }
+
+	failed := r.Begin(changes.Set{})
+	failed.Observe(StageBuild, time.Second)
+	failed.Finish(OutcomeBuildFailed)
+
+	ok := r.Begin(changes.Set{})
+	ok.Observe(StageBuild, 1500*time.Millisecond)
+	ok.Observe(StageHealthy, 20*time.Millisecond)
+	ok.Finish(OutcomeOK)
+	ok.Finish(OutcomeOK)
+
+	if len(lines) != 1 {
+		t.Fatalf("expected exactly one summary line, got %d: %v", len(lines), lines)
+	}
+	if !strings.Contains(lines[0], "build 1.50s") || !strings.Contains(lines[0], "healthy 20ms") {
+		t.Fatalf("unexpected summary: %s", lines[0])
+	}
+}
+
+func TestStatsPercentiles(t *testing.T) {
+	r := NewRecorder(100)
+	r.Print = nil
+	for i := 1; i <= 20; i++ {
+		c := r.Begin(changes.Set{})
+		c.Observe(StageBuild, time.Duration(i)*time.Millisecond)
+		c.Finish(OutcomeOK)
+	}
+	c := r.Begin(changes.Set{})
+	c.Observe(StageBuild, time.Hour)
+	c.Finish(OutcomeCanceled)
+
+	stats := r.Stats()
+	build := stats.Stages[StageBuild]
+	if build.Count != 20 {
+		t.Fatalf("expected 20 successful samples, got %d", build.Count)
+	}
+	if build.P50 != 10 || build.P95 != 19 || build.Last != 20 {
+		t.Fatalf("unexpected build stats: %+v", build)
+	}
+	if stats.Outcomes[OutcomeCanceled] != 1 {
+		t.Fatalf("expected canceled cycle to be counted, got %v", stats.Outcomes)
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	r := NewRecorder(3)
+	r.Print = nil
+	for range 5 {
+		r.Begin(changes.Set{}).Finish(OutcomeOK)
+	}
+	if got := r.Stats().Cycles; got != 3 {
+		t.Fatalf("expected 3 cycles in history, got %d", got)
+	}
+}
+
+func TestServeHTTPReturnsJSON(t *testing.T) {
+	r := NewRecorder(10)
+	r.Print = nil
+	r.Begin(changes.Set{}).Finish(OutcomeOK)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/__shadowfax/stats", nil))
+
+	var stats Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if stats.Cycles != 1 {
+		t.Fatalf("expected 1 cycle, got %d", stats.Cycles)
+	}
+}
+
+func TestNilRecorderIsNoop(t *testing.T) {
+	var r *Recorder
+	c := r.Begin(changes.Set{})
+	c.Observe(StageBuild, time.Second)
+	c.Finish(OutcomeOK)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ClientPath is where the proxy serves the reload client.
+const ClientPath = "/__shadowfax/client.js"
+
+//go:embed client.js
+var clientJS string
+
+// clientVersion identifies the embedded client. It is the ETag of
+// ClientPath and versions the injected src, so a new shadowfax never runs
+// a cached client.
+var clientVersion = func() string {
+	sum := sha256.Sum256([]byte(clientJS))
+	return hex.EncodeToString(sum[:8])
+}()
+
+var (
+	// HotReloadScript loads the reload client from the proxy.
+	HotReloadScript = `<script src="` + ClientPath + `?v=` + clientVersion + `"></script>`
+
+	// InlineReloadScript carries the whole reload client, for pages that
+	// shouldn't load it from the proxy.
+	InlineReloadScript = "<script>\n" + clientJS + "</script>"
+)
+
+// InlineClient injects the reload client inline instead of as a script
+// served from ClientPath.
+func (ps *Server) InlineClient() {
+	ps.inlineClient = true
+}
+
+// clientScript returns the tag injected into HTML pages.
+func (ps *Server) clientScript() string {
+	if ps.inlineClient {
+		return InlineReloadScript
+	}
+	return HotReloadScript
+}
+
+func (ps *Server) serveClient(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != ClientPath || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// Browsers revalidate on every page load and get a 304 until the client
+	// changes.
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", `"`+clientVersion+`"`)
+	http.ServeContent(w, r, "client.js", time.Time{}, strings.NewReader(clientJS))
+	return true
+}
@@ -0,0 +1,112 @@
+(function() {
+  var protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+  var wsUrl = protocol + '//' + window.location.host + '/__shadowfax/events';
+  var reconnectDelay = 1000;
+  var maxReconnectDelay = 5000;
+
+  function connect() {
+    var ws = new WebSocket(wsUrl);
+
+    ws.onopen = function() {
+      console.log('[shadowfax] Connected to hot reload server');
+      reconnectDelay = 1000;
+    };
+
+    ws.onmessage = function(event) {
+      if (event.data === 'r') {
+        console.log('[shadowfax] Reloading page...');
+        window.location.reload();
+        return;
+      }
+      var msg;
+      try { msg = JSON.parse(event.data); } catch (e) { return; }
+      if (msg.type === 'status') {
+        renderOverlay(msg.errors || []);
+      } else if (msg.type === 'rebuild') {
+        console.log('[shadowfax] Rebuilding: ' + (msg.files.length ? msg.files.map(function(f) { return f.path; }).join(', ') : msg.reason));
+        window.dispatchEvent(new CustomEvent('shadowfax:rebuild', { detail: msg }));
+      } else if (msg.type === 'css') {
+        swapStylesheets(msg.files || []);
+      } else if (msg.type === 'js') {
+        // Handlers that refresh their modules in place cancel the event.
+        if (window.dispatchEvent(new CustomEvent('shadowfax:js', { detail: msg, cancelable: true }))) {
+          console.log('[shadowfax] Scripts rebuilt, reloading page...');
+          window.location.reload();
+        }
+      }
+    };
+
+    ws.onclose = function() {
+      console.log('[shadowfax] Connection closed, reconnecting in ' + reconnectDelay + 'ms');
+      setTimeout(function() {
+        reconnectDelay = Math.min(reconnectDelay * 1.5, maxReconnectDelay);
+        connect();
+      }, reconnectDelay);
+    };
+
+    ws.onerror = function(err) {
+      console.log('[shadowfax] WebSocket error:', err);
+      ws.close();
+    };
+  }
+
+  // swapStylesheets re-fetches the proxied stylesheets built to files and
+  // swaps them in place, keeping the old sheet until the new one has loaded.
+  function swapStylesheets(files) {
+    var links = document.querySelectorAll('link[rel~="stylesheet"]:not([data-shadowfax-stale])');
+    var swapped = 0;
+    Array.prototype.forEach.call(links, function(link) {
+      var url = new URL(link.href, window.location.href);
+      if (url.host !== window.location.host || url.pathname.indexOf('/__shadowfax/assets/') !== 0) return;
+      if (files.length && files.indexOf(url.pathname.slice('/__shadowfax/'.length)) === -1) return;
+      url.searchParams.set('__shadowfax', Date.now());
+      var next = link.cloneNode();
+      next.href = url.toString();
+      next.onload = next.onerror = function() { link.remove(); };
+      link.setAttribute('data-shadowfax-stale', '');
+      link.parentNode.insertBefore(next, link.nextSibling);
+      swapped++;
+    });
+    if (!swapped) {
+      console.log('[shadowfax] No matching stylesheet, reloading page...');
+      window.location.reload();
+      return;
+    }
+    console.log('[shadowfax] Swapped ' + swapped + ' stylesheet(s)');
+  }
+
+  function renderOverlay(errors) {
+    var overlay = document.getElementById('__shadowfax_overlay');
+    if (!errors.length) {
+      if (overlay) overlay.remove();
+      return;
+    }
+    if (!overlay) {
+      overlay = document.createElement('div');
+      overlay.id = '__shadowfax_overlay';
+      overlay.style.cssText = 'position:fixed;left:0;right:0;bottom:0;max-height:50vh;overflow:auto;z-index:2147483647;' +
+        'background:rgba(17,24,39,0.96);color:#f9fafb;font:13px/1.45 ui-monospace,SFMono-Regular,Menlo,monospace;' +
+        'padding:12px 16px;border-top:3px solid #ef4444;box-shadow:0 -4px 16px rgba(0,0,0,0.3);';
+      document.body.appendChild(overlay);
+    }
+    overlay.textContent = '';
+    var close = document.createElement('button');
+    close.textContent = '\u00d7';
+    close.title = 'Dismiss';
+    close.style.cssText = 'float:right;background:none;border:0;color:inherit;font-size:18px;cursor:pointer;';
+    close.onclick = function() { overlay.remove(); };
+    overlay.appendChild(close);
+    errors.forEach(function(err) {
+      var title = document.createElement('div');
+      title.textContent = '[shadowfax] ' + err.source;
+      title.style.cssText = 'color:#fca5a5;font-weight:bold;margin-top:4px;';
+      var pre = document.createElement('pre');
+      pre.textContent = err.message;
+      pre.style.cssText = 'margin:4px 0 8px;white-space:pre-wrap;';
+      overlay.appendChild(title);
+      overlay.appendChild(pre);
+    });
+  }
+
+  connect();
+})();
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeClientRevalidatesWithETag(t *testing.T) {
+	ps, err := NewServer("http://localhost:1", "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ps.Handler(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ClientPath+"?v="+clientVersion, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != clientJS {
+		t.Fatalf("expected the client, got %d %q", rec.Code, rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") {
+		t.Fatalf("unexpected headers %v", rec.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, ClientPath, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a current client, got %d", rec.Code)
+	}
+}
+
+func TestInlineClientIsInjectedWhole(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html><head></head><body></body></html>")
+	}))
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.InlineClient()
+	rec := httptest.NewRecorder()
+	ps.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !strings.Contains(rec.Body.String(), InlineReloadScript+"</head>") {
+		t.Fatalf("expected the inline client, got %q", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), ClientPath) {
+		t.Fatal("expected no external client script")
+	}
+}
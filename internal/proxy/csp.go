@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	cspMetaRegex    = regexp.MustCompile(`(?is)<meta\b[^>]*\bhttp-equiv\s*=\s*["']?content-security-policy["']?[^>]*>`)
+	cspContentRegex = regexp.MustCompile(`(?is)\bcontent\s*=\s*("[^"]*"|'[^']*')`)
+	cspNonceRegex   = regexp.MustCompile(`^'nonce-([A-Za-z0-9+/_=-]+)'$`)
+)
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+type cspPolicy []cspDirective
+
+func parseCSP(policy string) cspPolicy {
+	var p cspPolicy
+	for _, part := range strings.Split(policy, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		p = append(p, cspDirective{name: strings.ToLower(fields[0]), sources: fields[1:]})
+	}
+	return p
+}
+
+func (p cspPolicy) String() string {
+	parts := make([]string, len(p))
+	for i, d := range p {
+		parts[i] = strings.Join(append([]string{d.name}, d.sources...), " ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// index returns the first of the directives names, in fallback order, that
+// the policy sets, or -1.
+func (p cspPolicy) index(names ...string) int {
+	for _, name := range names {
+		for i, d := range p {
+			if d.name == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// allow adds src to the directive at i. A default-src is copied into a new
+// directive named name instead, so other resource types keep their policy.
+func (p cspPolicy) allow(i int, name, src string) cspPolicy {
+	sources := slices.DeleteFunc(slices.Clone(p[i].sources), func(s string) bool {
+		return strings.EqualFold(s, "'none'")
+	})
+	sources = append(sources, src)
+	if p[i].name == "default-src" {
+		return append(p, cspDirective{name: name, sources: sources})
+	}
+	p[i].sources = sources
+	return p
+}
+
+// allowsInline reports whether sources allow any inline script. A nonce,
+// hash or 'strict-dynamic' turns 'unsafe-inline' off.
+func allowsInline(sources []string) bool {
+	inline := false
+	for _, s := range sources {
+		ls := strings.ToLower(s)
+		switch {
+		case ls == "'unsafe-inline'":
+			inline = true
+		case ls == "'strict-dynamic'", strings.HasPrefix(ls, "'nonce-"), strings.HasPrefix(ls, "'sha"):
+			return false
+		}
+	}
+	return inline
+}
+
+// cspRewrite makes the Content-Security-Policies of one response allow the
+// reload script and its websocket.
+type cspRewrite struct {
+	// nonce is set once a policy needs one. The page's own nonce is reused
+	// when there is one.
+	nonce    string
+	wsSource string
+	// clientSource is the URL of the external reload client, which pages
+	// allowing only inline scripts need added. Empty for the inline client.
+	clientSource string
+	path         string
+}
+
+// newCSPRewrite prepares the rewrite for resp, whose request was sent by
+// the proxy with the browser's host and scheme in X-Forwarded headers.
+func newCSPRewrite(resp *http.Response, wsPath string, externalClient bool) *cspRewrite {
+	c := &cspRewrite{}
+	if req := resp.Request; req != nil {
+		scheme := "http"
+		if req.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		if host := req.Header.Get("X-Forwarded-Host"); host != "" {
+			c.wsSource = strings.Replace(scheme, "http", "ws", 1) + "://" + host + wsPath
+			if externalClient {
+				c.clientSource = scheme + "://" + host + ClientPath
+			}
+		}
+		c.path = req.URL.Path
+	}
+	return c
+}
+
+// fixHeader rewrites the enforced policies of h. Report-only policies
+// don't block the script and are left alone.
+func (c *cspRewrite) fixHeader(h http.Header) {
+	values := h.Values("Content-Security-Policy")
+	if len(values) == 0 {
+		return
+	}
+	fixed := make([]string, len(values))
+	for i, v := range values {
+		// One header can carry several comma-separated policies.
+		policies := strings.Split(v, ",")
+		for j, policy := range policies {
+			policies[j] = c.fixPolicy(policy)
+		}
+		fixed[i] = strings.Join(policies, ", ")
+	}
+	h["Content-Security-Policy"] = fixed
+}
+
+// fixMeta rewrites the policies of <meta http-equiv> tags in content. After
+// the script is injected they can't be fixed any more.
+func (c *cspRewrite) fixMeta(content []byte, injected bool) []byte {
+	return cspMetaRegex.ReplaceAllFunc(content, func(tag []byte) []byte {
+		if injected {
+			c.warn("a <meta> policy after </head> can't be adjusted")
+			return tag
+		}
+		return cspContentRegex.ReplaceAllFunc(tag, func(attr []byte) []byte {
+			m := cspContentRegex.FindSubmatch(attr)
+			policy := html.UnescapeString(string(m[1][1 : len(m[1])-1]))
+			return []byte(`content="` + html.EscapeString(c.fixPolicy(policy)) + `"`)
+		})
+	})
+}
+
+func (c *cspRewrite) fixPolicy(policy string) string {
+	p := parseCSP(policy)
+	if len(p) == 0 {
+		return strings.TrimSpace(policy)
+	}
+
+	if i := p.index("sandbox"); i >= 0 && !slices.Contains(p[i].sources, "allow-scripts") {
+		c.warn("sandbox without allow-scripts blocks all scripts")
+		return strings.TrimSpace(policy)
+	}
+
+	if i := p.index("script-src-elem", "script-src", "default-src"); i >= 0 {
+		if !allowsInline(p[i].sources) {
+			if c.nonce == "" {
+				c.nonce = pageNonce(p[i].sources)
+			}
+			if src := "'nonce-" + c.nonce + "'"; !slices.Contains(p[i].sources, src) {
+				p = p.allow(i, "script-src", src)
+			}
+		} else if c.clientSource != "" && !slices.Contains(p[i].sources, c.clientSource) {
+			// A nonce would turn off the page's own inline scripts.
+			p = p.allow(i, "script-src", c.clientSource)
+		}
+	}
+
+	if c.wsSource != "" {
+		if i := p.index("connect-src", "default-src"); i >= 0 && !slices.Contains(p[i].sources, c.wsSource) {
+			p = p.allow(i, "connect-src", c.wsSource)
+		}
+	}
+	return p.String()
+}
+
+// script adds the nonce, if one is set, to the reload script tag.
+func (c *cspRewrite) script(tag string) string {
+	if c == nil || c.nonce == "" {
+		return tag
+	}
+	return strings.Replace(tag, "<script", `<script nonce="`+c.nonce+`"`, 1)
+}
+
+var warnedCSP sync.Map
+
+// warn logs, once per problem, that a policy still blocks the script.
+func (c *cspRewrite) warn(problem string) {
+	if _, seen := warnedCSP.LoadOrStore(problem, true); seen {
+		return
+	}
+	log.Printf("[shadowfax] Content-Security-Policy of %s blocks the reload script: %s", c.path, problem)
+}
+
+// pageNonce returns the first nonce in sources, or a new one.
+func pageNonce(sources []string) string {
+	for _, s := range sources {
+		if m := cspNonceRegex.FindStringSubmatch(s); m != nil {
+			return m[1]
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testWSSource = "ws://localhost:3000/__shadowfax/events"
+
+func TestCSPFixPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name, policy, want string
+	}{
+		{
+			"reuses page nonce",
+			"script-src 'nonce-abc123' 'strict-dynamic'; connect-src 'self'",
+			"script-src 'nonce-abc123' 'strict-dynamic'; connect-src 'self' " + testWSSource,
+		},
+		{
+			"inherits default-src",
+			"default-src 'self'",
+			"default-src 'self'; script-src 'self' 'nonce-abc123'; connect-src 'self' " + testWSSource,
+		},
+		{
+			"replaces none",
+			"script-src 'none'; connect-src 'none'",
+			"script-src 'nonce-abc123'; connect-src " + testWSSource,
+		},
+		{
+			"prefers script-src-elem",
+			"script-src 'self'; script-src-elem 'self'",
+			"script-src 'self'; script-src-elem 'self' 'nonce-abc123'",
+		},
+		{
+			"unsafe-inline left alone",
+			"script-src 'self' 'unsafe-inline'",
+			"script-src 'self' 'unsafe-inline'",
+		},
+		{
+			"unsafe-inline ignored next to a hash",
+			"script-src 'unsafe-inline' 'sha256-xyz'",
+			"script-src 'unsafe-inline' 'sha256-xyz' 'nonce-abc123'",
+		},
+		{
+			"unrelated policy",
+			"frame-ancestors 'none'",
+			"frame-ancestors 'none'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &cspRewrite{nonce: "abc123", wsSource: testWSSource}
+			if got := c.fixPolicy(tc.policy); got != tc.want {
+				t.Fatalf("fixPolicy(%q)\n got %q\nwant %q", tc.policy, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCSPAllowsExternalClientBesideInlineScripts(t *testing.T) {
+	c := &cspRewrite{clientSource: "http://localhost:3000" + ClientPath}
+	got := c.fixPolicy("script-src 'self' 'unsafe-inline'")
+	if want := "script-src 'self' 'unsafe-inline' " + c.clientSource; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if c.nonce != "" {
+		t.Fatal("expected no nonce, which would block the page's inline scripts")
+	}
+}
+
+func TestCSPPicksNonce(t *testing.T) {
+	c := &cspRewrite{}
+	c.fixPolicy("script-src 'nonce-fromPage=='")
+	if c.nonce != "fromPage==" {
+		t.Fatalf("expected the page's nonce to be reused, got %q", c.nonce)
+	}
+	if !strings.HasPrefix(c.script(HotReloadScript), `<script nonce="fromPage==" src=`) {
+		t.Fatalf("expected the script to carry the nonce, got %q", c.script(HotReloadScript)[:40])
+	}
+
+	c = &cspRewrite{}
+	c.fixPolicy("script-src 'self'")
+	if c.nonce == "" {
+		t.Fatal("expected a nonce to be generated")
+	}
+
+	c = &cspRewrite{}
+	c.fixPolicy("img-src 'self'")
+	if c.nonce != "" || c.script(HotReloadScript) != HotReloadScript {
+		t.Fatal("expected no nonce when scripts aren't restricted")
+	}
+}
+
+func TestCSPSandboxIsReported(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	c := &cspRewrite{path: "/sandboxed"}
+	policy := "sandbox; script-src 'self'"
+	if got := c.fixPolicy(policy); got != policy {
+		t.Fatalf("expected sandboxed policy unchanged, got %q", got)
+	}
+	if !strings.Contains(logs.String(), "Content-Security-Policy of /sandboxed blocks the reload script") {
+		t.Fatalf("expected a clear log message, got %q", logs.String())
+	}
+}
+
+func TestHTMLRewriterFixesMetaPolicy(t *testing.T) {
+	var out bytes.Buffer
+	c := &cspRewrite{wsSource: testWSSource}
+	rw := newHTMLRewriter(&out, HotReloadScript, c)
+	rw.Write([]byte(`<html><head><meta http-equiv="Content-Security-Policy" content="script-src &#39;nonce-m1&#39;"></head></html>`))
+	rw.Close()
+
+	want := `<meta http-equiv="Content-Security-Policy" content="script-src &#39;nonce-m1&#39;">`
+	if !strings.Contains(out.String(), want) {
+		t.Fatalf("expected meta policy with its nonce kept, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), `<script nonce="m1" src=`) {
+		t.Fatalf("expected script to reuse the meta nonce, got %q", out.String())
+	}
+}
+
+func TestProxyRewritesCSPHeader(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'nonce-app'")
+		io.WriteString(w, `<html><head><script nonce="app"></script></head><body></body></html>`)
+	}))
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:3000/", nil)
+	ps.ServeHTTP(rec, req)
+
+	policy := rec.Header().Get("Content-Security-Policy")
+	want := "default-src 'self'; script-src 'nonce-app'; connect-src 'self' " + testWSSource
+	if policy != want {
+		t.Fatalf("unexpected policy\n got %q\nwant %q", policy, want)
+	}
+	if !strings.Contains(rec.Body.String(), `<script nonce="app" src="`+ClientPath) {
+		t.Fatalf("expected the reload script to carry the app's nonce, got %q", rec.Body.String())
+	}
+}
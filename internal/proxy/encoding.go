@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec decodes and re-encodes one Content-Encoding. Encoders are flushed
+// after every rewritten chunk.
+type codec struct {
+	decode func(io.Reader) (io.ReadCloser, error)
+	encode func(io.Writer) (io.WriteCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {
+		decode: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		encode: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+	"br": {
+		decode: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(brotli.NewReader(r)), nil },
+		encode: func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil },
+	},
+	"zstd": {
+		decode: func(r io.Reader) (io.ReadCloser, error) {
+			// A single decoder goroutine hands out each frame block as it
+			// arrives instead of reading ahead.
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		encode: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	},
+	"deflate": {
+		decode: decodeDeflate,
+		encode: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+	},
+}
+
+// decodeDeflate reads "deflate" bodies, which are zlib streams by the spec
+// but raw deflate from some servers.
+func decodeDeflate(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// lookupCodec returns the codec of a Content-Encoding header. ok is false
+// for encodings the injector can't rewrite; nil codecs mean no encoding.
+func lookupCodec(encoding string) (c *codec, ok bool) {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == "identity" {
+		return nil, true
+	}
+	if c, ok := codecs[encoding]; ok {
+		return &c, true
+	}
+	return nil, false
+}
+
+var warnedEncodings sync.Map
+
+// warnUnknownEncoding logs, once per encoding, that responses are passed
+// through without the reload script.
+func warnUnknownEncoding(encoding string) {
+	if _, seen := warnedEncodings.LoadOrStore(encoding, true); seen {
+		return
+	}
+	log.Printf("[shadowfax] can't inject the reload script into %q encoded HTML, passing it through unchanged", encoding)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HoldRequests holds requests that arrive during a rebuild, or that can't
+// reach the app, until it is back, and then forwards them. Requests wait at
+// most maxWait, and bodies declared larger than maxBody aren't held. Bodies
+// aren't buffered ahead: at most maxBody bytes of what a failed attempt
+// read are kept for the replay.
+func (ps *Server) HoldRequests(maxWait time.Duration, maxBody int64) {
+	ps.holdMaxWait = maxWait
+	ps.holdMaxBody = maxBody
+}
+
+// forward sends r to the app, keeping what is read of its body for a replay
+// when holding is enabled.
+func (ps *Server) forward(w http.ResponseWriter, r *http.Request) {
+	if ps.holdMaxWait > 0 && r.Body != nil && r.Body != http.NoBody && !isWebSocketRequest(r) {
+		r.Body = &replayBody{body: r.Body, max: ps.holdMaxBody}
+	}
+	ps.proxy.ServeHTTP(w, r)
+}
+
+// replayBody keeps the first max bytes read from a request body, so that a
+// request that failed before the body was sent can be sent again. Bodies
+// aren't buffered ahead; a request that never reached the app has read
+// nothing yet.
+type replayBody struct {
+	body     io.ReadCloser
+	max      int64
+	read     bytes.Buffer
+	overflow bool
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if !b.overflow {
+		if int64(b.read.Len()+n) > b.max {
+			b.overflow = true
+			b.read = bytes.Buffer{}
+		} else {
+			b.read.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// Close leaves the body open for a replay. The server closes it once the
+// handler returns.
+func (b *replayBody) Close() error { return nil }
+
+// replay returns the whole body again: what was read so far and the rest.
+func (b *replayBody) replay() io.ReadCloser {
+	return io.NopCloser(io.MultiReader(bytes.NewReader(bytes.Clone(b.read.Bytes())), b.body))
+}
+
+// replayable reports whether r, as sent to the app, can be held and sent
+// again.
+func (ps *Server) replayable(r *http.Request) bool {
+	if ps.holdMaxWait <= 0 || isWebSocketRequest(r) {
+		return false
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	body, ok := r.Body.(*replayBody)
+	return ok && !body.overflow
+}
+
+// hold waits for the app to be back and marks r as retried. It reports
+// false when the wait timed out or the browser went away.
+func (ps *Server) hold(r *http.Request) bool {
+	log.Printf("[shadowfax] holding %s %s until the app is back", r.Method, r.URL.Path)
+	r.Header.Set(proxyRetryHeader, "1")
+	if !ps.waitForRestart(r.Context(), ps.holdMaxWait) {
+		if r.Context().Err() == nil {
+			log.Printf("[shadowfax] gave up holding %s %s after %s", r.Method, r.URL.Path, ps.holdMaxWait)
+		}
+		return false
+	}
+	return true
+}
+
+// waitForRestart waits until no rebuild is in progress and the app accepts
+// connections.
+func (ps *Server) waitForRestart(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for ps.isRebuilding != nil && ps.isRebuilding() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return ps.waitForUpstreamReady(ctx, time.Until(deadline))
+}
+
+// isDialError reports whether err means the request never reached the app,
+// so even non-idempotent requests are safe to send again.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func echoBodyApp() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+}
+
+func TestHoldForwardsRequestsAfterRebuild(t *testing.T) {
+	app := httptest.NewServer(echoBodyApp())
+	defer app.Close()
+
+	var rebuilding atomic.Bool
+	rebuilding.Store(true)
+	ps, err := NewServer(app.URL, "/__shadowfax/events", rebuilding.Load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.HoldRequests(5*time.Second, 1024)
+	handler := ps.Handler(http.NotFoundHandler())
+
+	time.AfterFunc(150*time.Millisecond, func() { rebuilding.Store(false) })
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader("name=gandalf")))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "name=gandalf" {
+		t.Fatalf("expected the held POST to reach the app, got %d %q", rec.Code, rec.Body.String())
+	}
+	if time.Since(start) < 150*time.Millisecond {
+		t.Fatal("expected the request to be held until the rebuild finished")
+	}
+}
+
+func TestHoldReplaysRequestsThatCouldNotConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ps, err := NewServer("http://"+addr, "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.HoldRequests(5*time.Second, 1024)
+	handler := ps.Handler(http.NotFoundHandler())
+
+	app := httptest.NewUnstartedServer(echoBodyApp())
+	defer app.Close()
+	time.AfterFunc(200*time.Millisecond, func() {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		app.Listener = l
+		app.Start()
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/item", strings.NewReader("payload")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("expected the PUT to be replayed once the app was up, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHoldGivesUp(t *testing.T) {
+	app := httptest.NewServer(echoBodyApp())
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", func() bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.HoldRequests(200*time.Millisecond, 4)
+	handler := ps.Handler(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("abc")))
+	if rec.Code != http.StatusServiceUnavailable || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("expected 503 after the max wait, got %d after %s", rec.Code, time.Since(start))
+	}
+
+	rec = httptest.NewRecorder()
+	start = time.Now()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large")))
+	if rec.Code != http.StatusServiceUnavailable || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("expected a body over the limit to fail right away, got %d after %s", rec.Code, time.Since(start))
+	}
+}
+
+func TestHoldStreamsBodiesOutsideRebuilds(t *testing.T) {
+	received := make(chan string, 1)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		io.ReadFull(r.Body, buf)
+		received <- string(buf)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.HoldRequests(5*time.Second, 1024)
+	handler := ps.Handler(http.NotFoundHandler())
+
+	body, bodyWriter := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", body))
+	}()
+
+	bodyWriter.Write([]byte("first"))
+	select {
+	case got := <-received:
+		if got != "first" {
+			t.Fatalf("unexpected body start %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the body to stream to the app instead of being buffered")
+	}
+	bodyWriter.Close()
+	<-done
+}
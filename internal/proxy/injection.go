@@ -2,74 +2,102 @@ package proxy
 
 import (
 	"bytes"
+	"io"
 	"regexp"
+	"slices"
 	"strings"
 )
 
 var stylesheetHrefRegex = regexp.MustCompile(`(?is)<link\b[^>]*\bhref\s*=\s*["']([^"']+)["'][^>]*>`)
 
-const HotReloadScript = `<script>
-(function() {
-  var protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-  var wsUrl = protocol + '//' + window.location.host + '/__shadowfax/events';
-  var reconnectDelay = 1000;
-  var maxReconnectDelay = 5000;
-
-  function connect() {
-    var ws = new WebSocket(wsUrl);
-
-    ws.onopen = function() {
-      console.log('[shadowfax] Connected to hot reload server');
-      reconnectDelay = 1000;
-    };
-
-    ws.onmessage = function(event) {
-      if (event.data === 'r') {
-        console.log('[shadowfax] Reloading page...');
-        window.location.reload();
-      }
-    };
-
-    ws.onclose = function() {
-      console.log('[shadowfax] Connection closed, reconnecting in ' + reconnectDelay + 'ms');
-      setTimeout(function() {
-        reconnectDelay = Math.min(reconnectDelay * 1.5, maxReconnectDelay);
-        connect();
-      }, reconnectDelay);
-    };
-
-    ws.onerror = function(err) {
-      console.log('[shadowfax] WebSocket error:', err);
-      ws.close();
-    };
-  }
-
-  connect();
-})();
-</script>`
-
-func InjectScript(content []byte) []byte {
-	script := []byte(HotReloadScript)
-
-	headClose := bytes.Index(bytes.ToLower(content), []byte("</head>"))
-	if headClose != -1 {
-		result := make([]byte, len(content)+len(script))
-		copy(result, content[:headClose])
-		copy(result[headClose:], script)
-		copy(result[headClose+len(script):], content[headClose:])
-		return result
-	}
-
-	bodyClose := bytes.Index(bytes.ToLower(content), []byte("</body>"))
-	if bodyClose != -1 {
-		result := make([]byte, len(content)+len(script))
-		copy(result, content[:bodyClose])
-		copy(result[bodyClose:], script)
-		copy(result[bodyClose+len(script):], content[bodyClose:])
-		return result
-	}
-
-	return append(content, script...)
+// maxHeldTag bounds how much of an unfinished tag the rewriter holds back
+// while waiting for its closing '>'.
+const maxHeldTag = 64 << 10
+
+// htmlRewriter rewrites an HTML body as it streams through: stylesheet hrefs
+// are rewritten and the reload script is injected before </head>, before
+// </body> in documents without one, or at the end. Only an unfinished tag
+// at the end of a write is held back, so flushed chunks pass straight
+// through. With a csp, <meta> policies are adjusted to allow the script.
+type htmlRewriter struct {
+	w        io.Writer
+	script   string
+	csp      *cspRewrite
+	pending  []byte
+	injected bool
+}
+
+func newHTMLRewriter(w io.Writer, script string, csp *cspRewrite) *htmlRewriter {
+	return &htmlRewriter{w: w, script: script, csp: csp}
+}
+
+func (h *htmlRewriter) Write(p []byte) (int, error) {
+	h.pending = append(h.pending, p...)
+	if err := h.emit(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes what's left, injecting the script if no closing tag came by.
+func (h *htmlRewriter) Close() error {
+	return h.emit(true)
+}
+
+func (h *htmlRewriter) emit(final bool) error {
+	end := len(h.pending)
+	if !final {
+		if i := bytes.LastIndexByte(h.pending, '<'); i >= 0 && bytes.IndexByte(h.pending[i:], '>') < 0 && end-i < maxHeldTag {
+			end = i
+		}
+	}
+
+	out := RewriteStylesheetHrefs(h.pending[:end])
+	if h.csp != nil {
+		out = h.csp.fixMeta(out, h.injected)
+	}
+	if !h.injected {
+		at := indexFold(out, "</head>")
+		if at < 0 {
+			at = indexFold(out, "</body>")
+		}
+		if at >= 0 {
+			out = slices.Concat(out[:at], []byte(h.csp.script(h.script)), out[at:])
+			h.injected = true
+		}
+	}
+	if final && !h.injected {
+		out = append(out, h.csp.script(h.script)...)
+		h.injected = true
+	}
+	h.pending = append(h.pending[:0], h.pending[end:]...)
+
+	if len(out) == 0 {
+		return nil
+	}
+	if _, err := h.w.Write(out); err != nil {
+		return err
+	}
+	if f, ok := h.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// indexFold returns the index of the first ASCII case-insensitive match of
+// tag in s, or -1.
+func indexFold(s []byte, tag string) int {
+	for i := 0; i+len(tag) <= len(s); i++ {
+		j := bytes.IndexByte(s[i:], tag[0])
+		if j < 0 || i+j+len(tag) > len(s) {
+			return -1
+		}
+		i += j
+		if bytes.EqualFold(s[i:i+len(tag)], []byte(tag)) {
+			return i
+		}
+	}
+	return -1
 }
 
 func RewriteStylesheetHrefs(content []byte) []byte {
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -40,3 +41,47 @@ func TestRewriteStylesheetHrefsTimestampedPathCanonicalized(t *testing.T) {
 		t.Fatalf("expected timestamp segment to be removed, got: %s", out)
 	}
 }
+
+func TestHTMLRewriterStreamsAndInjectsBeforeHead(t *testing.T) {
+	var out bytes.Buffer
+	rw := newHTMLRewriter(&out, HotReloadScript, nil)
+
+	rw.Write([]byte(`<html><head><title>t</title><link rel="styles`))
+	if got := out.String(); got != "<html><head><title>t</title>" {
+		t.Fatalf("expected only the unfinished tag to be held back, got %q", got)
+	}
+	rw.Write([]byte(`heet" href="/assets/css/style.css"></HE`))
+	rw.Write([]byte(`AD><body>streamed`))
+	if !strings.Contains(out.String(), `href="/__shadowfax/assets/css/style.css"`) {
+		t.Fatalf("expected split link tag to be rewritten, got %q", out.String())
+	}
+	if !strings.HasSuffix(out.String(), HotReloadScript+"</HEAD><body>streamed") {
+		t.Fatalf("expected script before </head> once it arrived, got %q", out.String())
+	}
+
+	rw.Write([]byte(`</body></html>`))
+	rw.Close()
+	if strings.Count(out.String(), HotReloadScript) != 1 {
+		t.Fatalf("expected the script once, got %q", out.String())
+	}
+}
+
+func TestHTMLRewriterFallbacks(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"body", "<p>hi</p></body></html>", "<p>hi</p>" + HotReloadScript + "</body></html>"},
+		{"end", "<p>fragment</p>", "<p>fragment</p>" + HotReloadScript},
+		{"unclosed tag", "<p>1 <", "<p>1 <" + HotReloadScript},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rw := newHTMLRewriter(&out, HotReloadScript, nil)
+			rw.Write([]byte(tc.in))
+			rw.Close()
+			if out.String() != tc.want {
+				t.Fatalf("got %q, want %q", out.String(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InspectorPath serves the request inspector page, and its data under
+// InspectorPath + ".json".
+const InspectorPath = "/__shadowfax/requests"
+
+const (
+	// DefaultInspectorHistory is how many exchanges the inspector keeps.
+	DefaultInspectorHistory = 100
+	// maxCapturedBody bounds the request and response body kept per exchange.
+	maxCapturedBody = 64 << 10
+)
+
+//go:embed inspector.html
+var inspectorHTML string
+
+// Exchange is one request proxied to the app and its response. Headers are
+// the ones the app saw and sent, before the proxy rewrote anything.
+type Exchange struct {
+	ID              uint64      `json:"id"`
+	Started         time.Time   `json:"started"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Proto           string      `json:"proto"`
+	RequestHeader   http.Header `json:"requestHeader"`
+	RequestBody     string      `json:"requestBody,omitempty"`
+	RequestSize     int64       `json:"requestSize"`
+	Status          int         `json:"status,omitempty"`
+	ResponseHeader  http.Header `json:"responseHeader,omitempty"`
+	ResponseBody    string      `json:"responseBody,omitempty"`
+	ResponseSize    int64       `json:"responseSize"`
+	BodiesTruncated bool        `json:"bodiesTruncated,omitempty"`
+	UpstreamMs      float64     `json:"upstreamMs"`
+	TotalMs         float64     `json:"totalMs"`
+	Injected        bool        `json:"injected"`
+	Error           string      `json:"error,omitempty"`
+
+	requestBody  *bodyCapture
+	responseBody *bodyCapture
+}
+
+// inspector keeps the last exchanges proxied to the app.
+type inspector struct {
+	mu        sync.Mutex
+	limit     int
+	nextID    uint64
+	exchanges []*Exchange
+}
+
+func newInspector(limit int) *inspector {
+	if limit <= 0 {
+		limit = DefaultInspectorHistory
+	}
+	return &inspector{limit: limit}
+}
+
+type exchangeKey struct{}
+
+func exchangeFrom(ctx context.Context) *Exchange {
+	ex, _ := ctx.Value(exchangeKey{}).(*Exchange)
+	return ex
+}
+
+// capture records the exchange of serve proxying r to the app.
+func (in *inspector) capture(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	ex := &Exchange{
+		Started:       time.Now(),
+		Method:        r.Method,
+		URL:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		RequestHeader: r.Header.Clone(),
+		requestBody:   &bodyCapture{},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, ex.requestBody), r.Body}
+	}
+
+	serve(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex)))
+
+	ex.TotalMs = ms(time.Since(ex.Started))
+	in.add(ex)
+}
+
+// recordResponse is called once the app's response headers arrived. The
+// body is teed as the proxy reads it.
+func (ex *Exchange) recordResponse(resp *http.Response) {
+	ex.UpstreamMs = ms(time.Since(ex.Started))
+	ex.Status = resp.StatusCode
+	ex.ResponseHeader = resp.Header.Clone()
+
+	// Upgraded connections need the body to stay the raw connection.
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil {
+		return
+	}
+	ex.responseBody = &bodyCapture{}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, ex.responseBody), resp.Body}
+}
+
+func (in *inspector) add(ex *Exchange) {
+	var truncated bool
+	ex.RequestBody, ex.RequestSize, truncated = ex.requestBody.text(mediaType(ex.RequestHeader), "")
+	ex.BodiesTruncated = truncated
+	if ex.responseBody != nil {
+		ex.ResponseBody, ex.ResponseSize, truncated = ex.responseBody.text(mediaType(ex.ResponseHeader), ex.ResponseHeader.Get("Content-Encoding"))
+		ex.BodiesTruncated = ex.BodiesTruncated || truncated
+	}
+	ex.requestBody, ex.responseBody = nil, nil
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.nextID++
+	ex.ID = in.nextID
+	in.exchanges = append(in.exchanges, ex)
+	if len(in.exchanges) > in.limit {
+		in.exchanges = in.exchanges[len(in.exchanges)-in.limit:]
+	}
+}
+
+// since returns the kept exchanges with an ID above after, oldest first.
+func (in *inspector) since(after uint64) []*Exchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := []*Exchange{}
+	for _, ex := range in.exchanges {
+		if ex.ID > after {
+			out = append(out, ex)
+		}
+	}
+	return out
+}
+
+func (in *inspector) serve(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Path {
+	case InspectorPath:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, inspectorHTML)
+	case InspectorPath + ".json":
+		after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"exchanges": in.since(after)})
+	default:
+		return false
+	}
+	return true
+}
+
+// bodyCapture keeps the first maxCapturedBody bytes written to it. The
+// proxy may still be reading a body when the exchange is recorded.
+type bodyCapture struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int64
+}
+
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if room := maxCapturedBody - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// text returns the captured body decoded for display, or "" for binary
+// media types, with the body's size on the wire.
+func (b *bodyCapture) text(mediaType, encoding string) (string, int64, bool) {
+	b.mu.Lock()
+	raw, size := bytes.Clone(b.buf), b.size
+	b.mu.Unlock()
+
+	truncated := size > int64(len(raw))
+	if !isTextMediaType(mediaType) {
+		return "", size, false
+	}
+	if c, ok := lookupCodec(encoding); !ok {
+		return "", size, false
+	} else if c != nil {
+		// A truncated body decodes as far as it goes.
+		dec, err := c.decode(bytes.NewReader(raw))
+		if err != nil {
+			return "", size, false
+		}
+		raw, _ = io.ReadAll(io.LimitReader(dec, maxCapturedBody))
+		dec.Close()
+	}
+	return strings.ToValidUTF8(string(raw), "�"), size, truncated
+}
+
+func mediaType(h http.Header) string {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt
+}
+
+func isTextMediaType(mt string) bool {
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "json"),
+		strings.HasSuffix(mt, "xml"),
+		strings.HasSuffix(mt, "javascript"),
+		mt == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
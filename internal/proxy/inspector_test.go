@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInspectorRecordsExchanges(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/submit":
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("HX-Redirect", "/done")
+			http.Redirect(w, r, "/done", http.StatusSeeOther)
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, "<html><head></head><body>page</body></html>")
+			gz.Close()
+		case "/large":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, strings.Repeat("x", maxCapturedBody+10))
+		}
+	}))
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ps.Handler(http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader("name=gandalf"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("HX-Request", "true")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/large", nil))
+
+	// The inspector itself isn't captured.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, InspectorPath, nil))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, InspectorPath+".json?after=0", nil))
+
+	var data struct{ Exchanges []Exchange }
+	if err := json.NewDecoder(rec.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Exchanges) != 3 {
+		t.Fatalf("expected 3 exchanges, got %+v", data.Exchanges)
+	}
+
+	submit := data.Exchanges[0]
+	if submit.Method != http.MethodPost || submit.Status != http.StatusSeeOther || submit.ResponseHeader.Get("Location") != "/done" {
+		t.Fatalf("unexpected redirect exchange %+v", submit)
+	}
+	if submit.RequestBody != "name=gandalf" || submit.RequestHeader.Get("HX-Request") != "true" || submit.ResponseHeader.Get("HX-Redirect") != "/done" {
+		t.Fatalf("expected request body and htmx headers, got %+v", submit)
+	}
+	if submit.Injected {
+		t.Fatal("expected no injection into a redirect")
+	}
+
+	page := data.Exchanges[1]
+	if !page.Injected || page.ResponseBody != "<html><head></head><body>page</body></html>" {
+		t.Fatalf("expected the app's decoded body and injection, got %+v", page)
+	}
+
+	large := data.Exchanges[2]
+	if !large.BodiesTruncated || len(large.ResponseBody) != maxCapturedBody || large.ResponseSize != maxCapturedBody+10 {
+		t.Fatalf("expected a truncated body, got %d of %d bytes", len(large.ResponseBody), large.ResponseSize)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, InspectorPath+".json?after=2", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&data); err != nil || len(data.Exchanges) != 1 || data.Exchanges[0].ID != 3 {
+		t.Fatalf("expected only exchanges after 2, got %+v", data.Exchanges)
+	}
+}
+
+func TestInspectorKeepsLastExchanges(t *testing.T) {
+	in := newInspector(2)
+	for range 3 {
+		in.add(&Exchange{requestBody: &bodyCapture{}})
+	}
+	if got := in.since(0); len(got) != 2 || got[0].ID != 2 {
+		t.Fatalf("expected the last two exchanges, got %+v", got)
+	}
+}
@@ -1,8 +1,6 @@
 package proxy
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -19,8 +17,6 @@ import (
 	"strings"
 	"time"
 	"unicode"
-
-	"github.com/andybalholm/brotli"
 )
 
 const localAssetsPrefix = "/__shadowfax/assets/"
@@ -33,6 +29,11 @@ type Server struct {
 	wsPath         string
 	projectRoot    string
 	isRebuilding   func() bool
+	routes         *http.ServeMux
+	inlineClient   bool
+	inspector      *inspector
+	holdMaxWait    time.Duration
+	holdMaxBody    int64
 }
 
 func NewServer(targetURL string, wsPath string, isRebuilding func() bool) (*Server, error) {
@@ -45,8 +46,18 @@ func NewServer(targetURL string, wsPath string, isRebuilding func() bool) (*Serv
 
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
+		host := req.Host
 		originalDirector(req)
 		req.Host = target.Host
+		// Retries pass through here again with the app's host.
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", host)
+		}
+		// The app is reached over plain HTTP; tell it when the browser
+		// isn't, so secure cookies and redirects keep working.
+		if req.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
 	}
 
 	ps := &Server{
@@ -54,6 +65,8 @@ func NewServer(targetURL string, wsPath string, isRebuilding func() bool) (*Serv
 		proxy:        proxy,
 		wsPath:       wsPath,
 		isRebuilding: isRebuilding,
+		routes:       http.NewServeMux(),
+		inspector:    newInspector(DefaultInspectorHistory),
 	}
 
 	if wd, err := os.Getwd(); err == nil {
@@ -67,6 +80,13 @@ func NewServer(targetURL string, wsPath string, isRebuilding func() bool) (*Serv
 }
 
 func (ps *Server) modifyResponse(resp *http.Response) error {
+	var ex *Exchange
+	if resp.Request != nil {
+		if ex = exchangeFrom(resp.Request.Context()); ex != nil {
+			ex.recordResponse(resp)
+		}
+	}
+
 	if isBodylessResponse(resp) {
 		return nil
 	}
@@ -76,64 +96,78 @@ func (ps *Server) modifyResponse(resp *http.Response) error {
 		return nil
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return err
+	encoding := resp.Header.Get("Content-Encoding")
+	c, ok := lookupCodec(encoding)
+	if !ok {
+		warnUnknownEncoding(encoding)
+		return nil
 	}
 
-	encoding := resp.Header.Get("Content-Encoding")
-	var decompressed []byte
+	csp := newCSPRewrite(resp, ps.wsPath, !ps.inlineClient)
+	csp.fixHeader(resp.Header)
+	script := ps.clientScript()
 
-	switch encoding {
-	case "gzip":
-		gr, err := gzip.NewReader(bytes.NewReader(body))
-		if err != nil {
-			return err
-		}
-		decompressed, err = io.ReadAll(gr)
-		gr.Close()
+	upstream := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer upstream.Close()
+		pw.CloseWithError(rewriteHTML(pw, upstream, c, script, csp))
+	}()
+
+	// The length changes, and without one the reverse proxy flushes every
+	// chunk as soon as it is rewritten.
+	resp.Body = streamBody{PipeReader: pr, upstream: upstream}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if ex != nil {
+		ex.Injected = true
+	}
+
+	return nil
+}
+
+// rewriteHTML decodes body, rewrites it and writes it to w re-encoded with
+// c. A nil codec means the body isn't encoded.
+func rewriteHTML(w io.Writer, body io.Reader, c *codec, script string, csp *cspRewrite) error {
+	src, out := body, w
+	var enc io.WriteCloser
+	if c != nil {
+		dec, err := c.decode(body)
 		if err != nil {
 			return err
 		}
-	case "br":
-		br := brotli.NewReader(bytes.NewReader(body))
-		decompressed, err = io.ReadAll(br)
-		if err != nil {
+		defer dec.Close()
+		if enc, err = c.encode(w); err != nil {
 			return err
 		}
-	default:
-		decompressed = body
-	}
-
-	modified := RewriteStylesheetHrefs(decompressed)
-	modified = InjectScript(modified)
-
-	var finalBody []byte
-	switch encoding {
-	case "gzip":
-		var buf bytes.Buffer
-		gw := gzip.NewWriter(&buf)
-		gw.Write(modified)
-		gw.Close()
-		finalBody = buf.Bytes()
-	case "br":
-		var buf bytes.Buffer
-		bw := brotli.NewWriter(&buf)
-		bw.Write(modified)
-		bw.Close()
-		finalBody = buf.Bytes()
-	default:
-		finalBody = modified
-	}
-
-	resp.Body = io.NopCloser(bytes.NewReader(finalBody))
-	resp.ContentLength = int64(len(finalBody))
-	resp.Header.Set("Content-Length", strconv.Itoa(len(finalBody)))
+		src, out = dec, enc
+	}
 
+	rw := newHTMLRewriter(out, script, csp)
+	if _, err := io.Copy(rw, src); err != nil {
+		return err
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+	if enc != nil {
+		return enc.Close()
+	}
 	return nil
 }
 
+// streamBody is a rewritten response body. Closing it also closes the
+// upstream body so the rewriting goroutine stops when the client goes away.
+type streamBody struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+func (b streamBody) Close() error {
+	b.PipeReader.Close()
+	return b.upstream.Close()
+}
+
 func isBodylessResponse(resp *http.Response) bool {
 	if resp == nil {
 		return false
@@ -145,12 +179,55 @@ func isBodylessResponse(resp *http.Response) bool {
 }
 
 func (ps *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if ps.serveLocalAsset(w, r) {
+	if ps.serveClient(w, r) || ps.serveLocalAsset(w, r) {
 		return
 	}
 	ps.proxy.ServeHTTP(w, r)
 }
 
+// Handle registers a shadowfax control endpoint, such as
+// /__shadowfax/rollback, that is served by the proxy itself instead of being
+// forwarded to the app.
+func (ps *Server) Handle(pattern string, handler http.Handler) {
+	ps.routes.Handle(pattern, handler)
+}
+
+// UseUpstreamH2C talks prior-knowledge HTTP/2 to the app. Upgrade requests,
+// like the app's own websockets, keep using HTTP/1.1 since HTTP/2 can't
+// carry them.
+func (ps *Server) UseUpstreamH2C() {
+	h1 := http.DefaultTransport.(*http.Transport).Clone()
+	h2 := h1.Clone()
+	h2.Protocols = new(http.Protocols)
+	h2.Protocols.SetUnencryptedHTTP2(true)
+	ps.proxy.Transport = upgradeSplitTransport{h1: h1, h2: h2}
+}
+
+// upgradeSplitTransport sends upgrade requests over h1 and everything else
+// over h2.
+type upgradeSplitTransport struct {
+	h1, h2 http.RoundTripper
+}
+
+func (t upgradeSplitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Upgrade") != "" {
+		return t.h1.RoundTrip(req)
+	}
+	return t.h2.RoundTrip(req)
+}
+
+func (ps *Server) serveRoute(w http.ResponseWriter, r *http.Request) bool {
+	if ps.routes == nil {
+		return false
+	}
+	handler, pattern := ps.routes.Handler(r)
+	if pattern == "" {
+		return false
+	}
+	handler.ServeHTTP(w, r)
+	return true
+}
+
 func (ps *Server) Handler(wsHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if this is a WebSocket request to our endpoint
@@ -158,15 +235,23 @@ func (ps *Server) Handler(wsHandler http.Handler) http.Handler {
 			wsHandler.ServeHTTP(w, r)
 			return
 		}
-		if ps.serveLocalAsset(w, r) {
+		if ps.serveRoute(w, r) {
+			return
+		}
+		if ps.serveClient(w, r) || ps.inspector.serve(w, r) || ps.serveLocalAsset(w, r) {
 			return
 		}
 		if ps.isRebuilding != nil && ps.isRebuilding() {
+			// The body isn't read while the request waits.
+			if ps.holdMaxWait > 0 && !isWebSocketRequest(r) && r.ContentLength <= ps.holdMaxBody && ps.hold(r) {
+				ps.inspector.capture(w, r, ps.forward)
+				return
+			}
 			r.Header.Set(proxyRetryHeader, "1")
 			ps.handleProxyError(w, r, errors.New("server restart in progress"))
 			return
 		}
-		ps.proxy.ServeHTTP(w, r)
+		ps.inspector.capture(w, r, ps.forward)
 	})
 }
 
@@ -284,6 +369,9 @@ func (ps *Server) resolveLocalAssetPath(assetRelativePath string) (string, bool)
 
 func (ps *Server) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
 	log.Printf("[shadowfax] proxy upstream unavailable: %v", err)
+	if ex := exchangeFrom(r.Context()); ex != nil {
+		ex.Error = err.Error()
+	}
 
 	// Keep websocket handshakes as plain HTTP errors.
 	if isWebSocketRequest(r) {
@@ -291,6 +379,18 @@ func (ps *Server) handleProxyError(w http.ResponseWriter, r *http.Request, err e
 		return
 	}
 
+	// Requests that never reached the app are held until it is back.
+	if r.Header.Get(proxyRetryHeader) == "" && isDialError(err) && ps.replayable(r) {
+		if ps.hold(r) {
+			retryReq := r.Clone(r.Context())
+			if body, ok := r.Body.(*replayBody); ok {
+				retryReq.Body = body.replay()
+			}
+			ps.proxy.ServeHTTP(w, retryReq)
+			return
+		}
+	}
+
 	// For idempotent navigation requests, do a short optimistic wait/retry
 	// so fast app restarts avoid rendering the fallback page entirely.
 	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Header.Get(proxyRetryHeader) == "" {
@@ -340,7 +440,7 @@ func (ps *Server) renderRestartPage(w http.ResponseWriter, r *http.Request) {
     }, 3000);
   </script>
 </body>
-</html>`, ps.target.String(), HotReloadScript)
+</html>`, ps.target.String(), ps.clientScript())
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-store, must-revalidate")
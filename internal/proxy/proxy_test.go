@@ -1,6 +1,10 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"errors"
 	"io"
 	"net/http"
@@ -11,6 +15,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestServeLocalAssetGET(t *testing.T) {
@@ -294,3 +301,240 @@ func TestProxyUnavailableHeadReturnsNoBody(t *testing.T) {
 		t.Fatalf("expected HTML content type, got %q", got)
 	}
 }
+
+func TestProxyForwardsHTTPSScheme(t *testing.T) {
+	protos := make(chan string, 2)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Header.Get("X-Forwarded-Proto")
+	}))
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	handler := ps.Handler(http.NotFoundHandler())
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://localhost:3000/", nil))
+	if got := <-protos; got != "https" {
+		t.Fatalf("expected X-Forwarded-Proto https, got %q", got)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost:3000/", nil))
+	if got := <-protos; got != "" {
+		t.Fatalf("expected no X-Forwarded-Proto over HTTP, got %q", got)
+	}
+}
+
+func TestUpstreamH2CKeepsUpgradesOnHTTP1(t *testing.T) {
+	protos := make(chan string, 2)
+	app := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+		if r.Header.Get("Upgrade") == "" {
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		buf.Flush()
+	}))
+	app.Config.Protocols = new(http.Protocols)
+	app.Config.Protocols.SetHTTP1(true)
+	app.Config.Protocols.SetUnencryptedHTTP2(true)
+	app.Start()
+	defer app.Close()
+
+	ps, err := NewServer(app.URL, "/__shadowfax/events", nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	ps.UseUpstreamH2C()
+	front := httptest.NewServer(ps.Handler(http.NotFoundHandler()))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-protos; got != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2 upstream, got %s", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected upgrade to pass through, got %d", resp.StatusCode)
+	}
+	if got := <-protos; got != "HTTP/1.1" {
+		t.Fatalf("expected upgrade over HTTP/1.1, got %s", got)
+	}
+}
+
+func TestModifyResponseStreamsHTML(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"":     nil,
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			enc, _ := zstd.NewWriter(w)
+			return enc
+		},
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	}
+	for encoding, newEncoder := range encoders {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			release := make(chan struct{})
+			app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				var out io.Writer = w
+				var enc io.WriteCloser
+				if newEncoder != nil {
+					w.Header().Set("Content-Encoding", encoding)
+					enc = newEncoder(w)
+					out = enc
+				}
+				io.WriteString(out, "<html><head><title>t</title></head>")
+				if f, ok := enc.(interface{ Flush() error }); ok {
+					f.Flush()
+				}
+				w.(http.Flusher).Flush()
+				<-release
+				io.WriteString(out, "<body>done</body></html>")
+				if enc != nil {
+					enc.Close()
+				}
+			}))
+			defer app.Close()
+			defer close(release)
+
+			ps, err := NewServer(app.URL, "/__shadowfax/events", nil)
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			front := httptest.NewServer(ps.Handler(http.NotFoundHandler()))
+			defer front.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+			req.Header.Set("Accept-Encoding", "gzip, br")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Fatalf("expected encoding %q to be kept, got %q", encoding, got)
+			}
+			if resp.ContentLength != -1 {
+				t.Fatalf("expected a streamed response, got length %d", resp.ContentLength)
+			}
+
+			var body io.Reader = resp.Body
+			switch encoding {
+			case "gzip":
+				if body, err = gzip.NewReader(resp.Body); err != nil {
+					t.Fatal(err)
+				}
+			case "br":
+				body = brotli.NewReader(resp.Body)
+			case "zstd":
+				dec, err := zstd.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer dec.Close()
+				body = dec
+			case "deflate":
+				if body, err = zlib.NewReader(resp.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The head arrives while the app is still rendering.
+			var got []byte
+			buf := make([]byte, 4096)
+			for !bytes.Contains(got, []byte("</head>")) {
+				n, err := body.Read(buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					t.Fatalf("reading streamed head: %v (got %q)", err, got)
+				}
+			}
+			if !bytes.Contains(got, []byte(HotReloadScript+"</head>")) {
+				t.Fatalf("expected script before </head>, got %q", got)
+			}
+
+			release <- struct{}{}
+			rest, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(rest), "<body>done</body></html>") {
+				t.Fatalf("unexpected rest of body %q", rest)
+			}
+		})
+	}
+}
+
+func TestModifyResponsePassesUnknownEncodingThrough(t *testing.T) {
+	original := "\x28\xb5compressed<html></html>"
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":     []string{"text/html"},
+			"Content-Encoding": []string{"compress"},
+			"Content-Length":   []string{strconv.Itoa(len(original))},
+		},
+		Body: io.NopCloser(strings.NewReader(original)),
+	}
+
+	if err := (&Server{}).modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse returned error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != original {
+		t.Fatalf("expected body to pass through untouched, got %q", body)
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(original)) {
+		t.Fatalf("expected content-length unchanged, got %q", got)
+	}
+}
+
+func TestModifyResponseAcceptsRawDeflate(t *testing.T) {
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	io.WriteString(fw, "<html><head></head><body>raw</body></html>")
+	fw.Close()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":     []string{"text/html"},
+			"Content-Encoding": []string{"deflate"},
+		},
+		Body: io.NopCloser(&compressed),
+	}
+	if err := (&Server{}).modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse returned error: %v", err)
+	}
+	zr, err := zlib.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("expected a zlib body back: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), HotReloadScript+"</head>") {
+		t.Fatalf("expected script to be injected, got %q", body)
+	}
+}
@@ -5,31 +5,38 @@ import (
 	"time"
 )
 
+// Message is a single frame pushed to connected browsers. MessageReload asks
+// the page to reload; status messages carry JSON for the error overlay.
+type Message string
+
+const MessageReload Message = "r"
+
 // Broadcaster is a thread-safe pub/sub for reload events.
 // Listeners can subscribe to receive reload signals.
 type Broadcaster struct {
 	mu            sync.RWMutex
-	listeners     map[chan struct{}]struct{}
+	listeners     map[chan Message]struct{}
 	lastBroadcast time.Time
 	debounceTime  time.Duration
+	status        Message
 }
 
 func NewBroadcaster() *Broadcaster {
 	return &Broadcaster{
-		listeners:    make(map[chan struct{}]struct{}),
+		listeners:    make(map[chan Message]struct{}),
 		debounceTime: 50 * time.Millisecond,
 	}
 }
 
-func (b *Broadcaster) Subscribe() chan struct{} {
-	ch := make(chan struct{}, 1)
+func (b *Broadcaster) Subscribe() chan Message {
+	ch := make(chan Message, 4)
 	b.mu.Lock()
 	b.listeners[ch] = struct{}{}
 	b.mu.Unlock()
 	return ch
 }
 
-func (b *Broadcaster) Unsubscribe(ch chan struct{}) {
+func (b *Broadcaster) Unsubscribe(ch chan Message) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if _, ok := b.listeners[ch]; ok {
@@ -48,17 +55,65 @@ func (b *Broadcaster) Broadcast() {
 	b.lastBroadcast = now
 	b.mu.Unlock()
 
+	b.send(MessageReload)
+}
+
+// SetStatus replaces the current status message and pushes it to all
+// listeners. New connections receive the latest status on subscribe.
+func (b *Broadcaster) SetStatus(msg Message) {
+	b.mu.Lock()
+	b.status = msg
+	b.mu.Unlock()
+
+	b.send(msg)
+}
+
+// Notify pushes a one-off message to all listeners. Unlike SetStatus it is
+// not replayed to new connections.
+func (b *Broadcaster) Notify(msg Message) {
+	b.send(msg)
+}
+
+// Status returns the most recent status message.
+func (b *Broadcaster) Status() Message {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.status
+}
+
+func (b *Broadcaster) send(msg Message) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	for ch := range b.listeners {
+		if msg == MessageReload {
+			pushReload(ch)
+			continue
+		}
 		select {
-		case ch <- struct{}{}:
+		case ch <- msg:
 		default:
 			// Channel buffer full, skip (listener will catch up on next broadcast)
 		}
 	}
 }
 
+// pushReload queues a reload on ch, evicting the oldest frames while the
+// buffer is full. The reloaded page receives the current status when it
+// reconnects, so nothing queued before the reload is needed.
+func pushReload(ch chan Message) {
+	for {
+		select {
+		case ch <- MessageReload:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
 func (b *Broadcaster) ListenerCount() int {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
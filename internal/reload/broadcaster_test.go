@@ -3,6 +3,8 @@ package reload
 import (
 	"testing"
 	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
 )
 
 func TestBroadcastNotifiesListeners(t *testing.T) {
@@ -82,7 +84,7 @@ func TestMultipleListeners(t *testing.T) {
 
 	b.Broadcast()
 
-	for i, ch := range []chan struct{}{ch1, ch2} {
+	for i, ch := range []chan Message{ch1, ch2} {
 		select {
 		case <-ch:
 		case <-time.After(100 * time.Millisecond):
@@ -90,3 +92,94 @@ func TestMultipleListeners(t *testing.T) {
 		}
 	}
 }
+
+func TestBroadcastSendsReloadMessage(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+	defer b.Unsubscribe(ch)
+
+	b.Broadcast()
+
+	if got := <-ch; got != MessageReload {
+		t.Fatalf("expected reload message, got %q", got)
+	}
+}
+
+func TestSetStatusIsNotDebounced(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+	defer b.Unsubscribe(ch)
+
+	b.Broadcast()
+	<-ch
+
+	status := StatusMessage(nil)
+	b.SetStatus(status)
+
+	select {
+	case got := <-ch:
+		if got != status {
+			t.Fatalf("expected status message, got %q", got)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("status message should bypass the reload debounce")
+	}
+	if b.Status() != status {
+		t.Fatal("expected latest status to be retained for new listeners")
+	}
+}
+
+func TestNotifySendsRebuildMessage(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+	defer b.Unsubscribe(ch)
+
+	set := changes.Set{}
+	set.Add("internal/db/users.go", changes.OpWrite)
+	b.Notify(RebuildMessage(set))
+
+	got := <-ch
+	if string(got) != `{"type":"rebuild","files":[{"path":"internal/db/users.go","op":"write"}]}` {
+		t.Fatalf("unexpected rebuild message: %s", got)
+	}
+	if b.Status() != "" {
+		t.Fatal("notifications should not replace the status")
+	}
+}
+
+func TestCSSMessage(t *testing.T) {
+	got := CSSMessage([]string{"./assets/css/style.css", "assets/css/admin.css"})
+	if string(got) != `{"type":"css","files":["assets/css/style.css","assets/css/admin.css"]}` {
+		t.Fatalf("unexpected css message: %s", got)
+	}
+	if got := CSSMessage(nil); string(got) != `{"type":"css","files":[]}` {
+		t.Fatalf("unexpected css message: %s", got)
+	}
+}
+
+func TestJSMessage(t *testing.T) {
+	got := JSMessage([]string{"assets/js/app.js"})
+	if string(got) != `{"type":"js","files":["assets/js/app.js"]}` {
+		t.Fatalf("unexpected js message: %s", got)
+	}
+}
+
+func TestBroadcastReloadIsNeverDropped(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+	defer b.Unsubscribe(ch)
+
+	for range cap(ch) + 2 {
+		b.SetStatus(`{"type":"status"}`)
+		b.Notify(`{"type":"test"}`)
+	}
+	b.Broadcast()
+
+	var got []Message
+	for len(ch) > 0 {
+		got = append(got, <-ch)
+	}
+	if len(got) == 0 || got[len(got)-1] != MessageReload {
+		t.Fatalf("expected the reload to be queued behind the status frames, got %v", got)
+	}
+}
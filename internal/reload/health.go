@@ -2,7 +2,6 @@ package reload
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 )
@@ -61,7 +60,9 @@ func (h *HealthChecker) WaitForHealthyWithTimeout(timeout time.Duration, pollInt
 	return h.WaitForHealthy(ctx, pollInterval)
 }
 
-func BroadcastWhenHealthy(ctx context.Context, healthURL string, broadcaster *Broadcaster) {
+// WaitForServer waits for a freshly started server at healthURL to answer
+// health checks, giving up after 30 seconds.
+func WaitForServer(ctx context.Context, healthURL string) error {
 	checker := NewHealthChecker(healthURL)
 
 	// Wait a brief moment for the server to actually stop
@@ -71,15 +72,11 @@ func BroadcastWhenHealthy(ctx context.Context, healthURL string, broadcaster *Br
 	waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	err := checker.WaitForHealthy(waitCtx, 100*time.Millisecond)
-	if err != nil {
-		fmt.Printf("[shadowfax] Server health check timed out: %v\n", err)
-		return
+	if err := checker.WaitForHealthy(waitCtx, 100*time.Millisecond); err != nil {
+		return err
 	}
 
 	// Small delay to ensure server is fully ready
 	time.Sleep(50 * time.Millisecond)
-
-	broadcaster.Broadcast()
-	fmt.Println("[shadowfax] Server healthy, broadcasting reload")
+	return nil
 }
@@ -0,0 +1,70 @@
+package reload
+
+import (
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/state"
+)
+
+type statusPayload struct {
+	Type   string        `json:"type"`
+	Errors []state.Error `json:"errors"`
+}
+
+// StatusMessage encodes the tracker errors for the browser error overlay. An
+// empty list hides the overlay.
+func StatusMessage(errs []state.Error) Message {
+	if errs == nil {
+		errs = []state.Error{}
+	}
+	data, _ := json.Marshal(statusPayload{Type: "status", Errors: errs})
+	return Message(data)
+}
+
+type rebuildPayload struct {
+	Type   string         `json:"type"`
+	Files  []changes.File `json:"files"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+// RebuildMessage announces a rebuild and the files that triggered it. The
+// client script re-dispatches it as a "shadowfax:rebuild" DOM event.
+func RebuildMessage(set changes.Set) Message {
+	files := set.Files
+	if files == nil {
+		files = []changes.File{}
+	}
+	data, _ := json.Marshal(rebuildPayload{Type: "rebuild", Files: files, Reason: set.Reason})
+	return Message(data)
+}
+
+type assetPayload struct {
+	Type  string   `json:"type"`
+	Files []string `json:"files"`
+}
+
+// CSSMessage asks the client to swap the stylesheets built to files, given
+// as project-relative paths, without reloading the page. With no files every
+// proxied stylesheet is refreshed.
+func CSSMessage(files []string) Message {
+	return assetMessage("css", files)
+}
+
+// JSMessage announces rebuilt scripts. The client dispatches a cancelable
+// "shadowfax:js" DOM event and reloads the page unless a handler cancels it.
+func JSMessage(files []string) Message {
+	return assetMessage("js", files)
+}
+
+func assetMessage(kind string, files []string) Message {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, strings.TrimPrefix(path.Clean(filepath.ToSlash(file)), "/"))
+	}
+	data, _ := json.Marshal(assetPayload{Type: kind, Files: paths})
+	return Message(data)
+}
@@ -48,6 +48,13 @@ func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reloadCh := h.broadcaster.Subscribe()
 	defer h.broadcaster.Unsubscribe(reloadCh)
 
+	if status := h.broadcaster.Status(); status != "" {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(status)); err != nil {
+			return
+		}
+	}
+
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
@@ -72,9 +79,12 @@ func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		select {
 		case <-ctx.Done():
 			return
-		case <-reloadCh:
+		case msg, ok := <-reloadCh:
+			if !ok {
+				return
+			}
 			conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := conn.WriteMessage(websocket.TextMessage, []byte("r")); err != nil {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeepBuilds is the number of successful binaries kept in tmp/bin.
+const DefaultKeepBuilds = 3
+
+// ErrNoPreviousBuild is returned by Rollback when there is no older healthy
+// build to fall back to.
+var ErrNoPreviousBuild = errors.New("no previous good build available")
+
+// Build describes a successfully compiled app binary kept in tmp/bin.
+type Build struct {
+	ID           string    `json:"id"`
+	BinPath      string    `json:"binPath"`
+	BuiltAt      time.Time `json:"builtAt"`
+	GitSHA       string    `json:"gitSha,omitempty"`
+	ChangedFiles []string  `json:"changedFiles,omitempty"`
+	Healthy      bool      `json:"healthy"`
+}
+
+func (b Build) metaPath() string {
+	return b.BinPath + ".json"
+}
+
+// buildHistory keeps the last N successful builds on disk, oldest first.
+type buildHistory struct {
+	mu     sync.Mutex
+	dir    string
+	keep   int
+	builds []Build
+}
+
+func newBuildHistory(dir string, keep int) *buildHistory {
+	if keep < 1 {
+		keep = DefaultKeepBuilds
+	}
+	return &buildHistory{dir: dir, keep: keep}
+}
+
+// load picks up builds left in dir by a previous run. Metadata whose binary
+// is gone is discarded.
+func (h *buildHistory) load() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	matches, _ := filepath.Glob(filepath.Join(h.dir, "server_*.json"))
+	h.builds = h.builds[:0]
+	for _, metaPath := range matches {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+		var b Build
+		if err := json.Unmarshal(data, &b); err != nil || b.BinPath == "" {
+			os.Remove(metaPath)
+			continue
+		}
+		if _, err := os.Stat(b.BinPath); err != nil {
+			os.Remove(metaPath)
+			continue
+		}
+		h.builds = append(h.builds, b)
+	}
+	sort.Slice(h.builds, func(i, j int) bool {
+		return h.builds[i].BuiltAt.Before(h.builds[j].BuiltAt)
+	})
+	h.pruneLocked()
+}
+
+// add records a new successful build and prunes the history.
+func (h *buildHistory) add(b Build) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.builds = append(h.builds, b)
+	h.writeLocked(b)
+	h.pruneLocked()
+}
+
+// markHealthy flags the build at binPath as having passed a health check.
+func (h *buildHistory) markHealthy(binPath string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.builds {
+		if h.builds[i].BinPath == binPath && !h.builds[i].Healthy {
+			h.builds[i].Healthy = true
+			h.writeLocked(h.builds[i])
+		}
+	}
+}
+
+// previous returns the newest healthy build that is older than the one at
+// currentBin.
+func (h *buildHistory) previous(currentBin string) (Build, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	end := len(h.builds)
+	for i, b := range h.builds {
+		if b.BinPath == currentBin {
+			end = i
+			break
+		}
+	}
+	for i := end - 1; i >= 0; i-- {
+		if h.builds[i].Healthy {
+			return h.builds[i], true
+		}
+	}
+	return Build{}, false
+}
+
+func (h *buildHistory) list() []Build {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]Build, len(h.builds))
+	copy(out, h.builds)
+	return out
+}
+
+func (h *buildHistory) writeLocked(b Build) {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(b.metaPath(), data, 0o644)
+}
+
+// pruneLocked drops the oldest builds beyond keep, except for the newest
+// healthy one, so there is always a good build to roll back to.
+func (h *buildHistory) pruneLocked() {
+	healthy := -1
+	for i, b := range h.builds {
+		if b.Healthy {
+			healthy = i
+		}
+	}
+	for i := 0; len(h.builds) > h.keep && i < len(h.builds); {
+		if i == healthy {
+			i++
+			continue
+		}
+		os.Remove(h.builds[i].BinPath)
+		os.Remove(h.builds[i].metaPath())
+		h.builds = append(h.builds[:i], h.builds[i+1:]...)
+		if healthy > i {
+			healthy--
+		}
+	}
+}
+
+// gitHead returns the short SHA of HEAD, or "" outside a git checkout.
+func gitHead(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+)
+
+func TestBuildHistoryPrunesOldestBinaries(t *testing.T) {
+	dir := t.TempDir()
+	h := newBuildHistory(dir, 2)
+
+	var builds []Build
+	for i := range 3 {
+		builds = append(builds, writeFakeBuild(t, dir, i))
+		h.add(builds[i])
+	}
+
+	if got := len(h.list()); got != 2 {
+		t.Fatalf("expected 2 retained builds, got %d", got)
+	}
+	if _, err := os.Stat(builds[0].BinPath); !os.IsNotExist(err) {
+		t.Fatal("expected oldest binary to be removed")
+	}
+	if _, err := os.Stat(builds[0].metaPath()); !os.IsNotExist(err) {
+		t.Fatal("expected oldest metadata to be removed")
+	}
+	if _, err := os.Stat(builds[2].metaPath()); err != nil {
+		t.Fatalf("expected newest metadata to be written: %v", err)
+	}
+}
+
+func TestBuildHistoryPruneKeepsNewestHealthyBuild(t *testing.T) {
+	dir := t.TempDir()
+	h := newBuildHistory(dir, 2)
+
+	healthy := writeFakeBuild(t, dir, 0)
+	h.add(healthy)
+	h.markHealthy(healthy.BinPath)
+	var broken []Build
+	for i := 1; i <= 3; i++ {
+		broken = append(broken, writeFakeBuild(t, dir, i))
+		h.add(broken[i-1])
+	}
+
+	got := h.list()
+	if len(got) != 2 || got[0].BinPath != healthy.BinPath || got[1].BinPath != broken[2].BinPath {
+		t.Fatalf("expected the healthy and the newest build to be kept, got %+v", got)
+	}
+	if _, err := os.Stat(healthy.BinPath); err != nil {
+		t.Fatalf("expected the healthy binary to be kept: %v", err)
+	}
+	if prev, ok := h.previous(broken[2].BinPath); !ok || prev.BinPath != healthy.BinPath {
+		t.Fatalf("expected to roll back to the healthy build, got %+v", prev)
+	}
+}
+
+func TestBuildHistoryPreviousSkipsUnhealthyBuilds(t *testing.T) {
+	dir := t.TempDir()
+	h := newBuildHistory(dir, 5)
+
+	first := writeFakeBuild(t, dir, 0)
+	second := writeFakeBuild(t, dir, 1)
+	third := writeFakeBuild(t, dir, 2)
+	h.add(first)
+	h.add(second)
+	h.add(third)
+	h.markHealthy(first.BinPath)
+
+	prev, ok := h.previous(third.BinPath)
+	if !ok {
+		t.Fatal("expected a previous healthy build")
+	}
+	if prev.BinPath != first.BinPath {
+		t.Fatalf("expected rollback target %s, got %s", first.ID, prev.ID)
+	}
+
+	if _, ok := h.previous(first.BinPath); ok {
+		t.Fatal("expected no build older than the first one")
+	}
+}
+
+func TestBuildHistoryLoadRestoresMetadata(t *testing.T) {
+	dir := t.TempDir()
+	h := newBuildHistory(dir, 3)
+	b := writeFakeBuild(t, dir, 0)
+	b.GitSHA = "abc1234"
+	h.add(b)
+	h.markHealthy(b.BinPath)
+
+	orphan := writeFakeBuild(t, dir, 1)
+	h.add(orphan)
+	os.Remove(orphan.BinPath)
+
+	reloaded := newBuildHistory(dir, 3)
+	reloaded.load()
+
+	got := reloaded.list()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 build after reload, got %d", len(got))
+	}
+	if got[0].GitSHA != "abc1234" || !got[0].Healthy {
+		t.Fatalf("unexpected reloaded build: %+v", got[0])
+	}
+}
+
+func TestRollbackWithoutHistoryFails(t *testing.T) {
+	s := NewAppServer(Config{})
+	s.history = newBuildHistory(t.TempDir(), 3)
+
+	if _, err := s.Rollback(); err != ErrNoPreviousBuild {
+		t.Fatalf("expected ErrNoPreviousBuild, got %v", err)
+	}
+}
+
+func TestRestartMergesPendingRequests(t *testing.T) {
+	s := NewAppServer(Config{})
+
+	first := changes.Set{}
+	first.Add("config/app.yaml", changes.OpWrite)
+	second := changes.Set{}
+	second.Add("config/db.yaml", changes.OpWrite)
+	s.Restart(first)
+	s.Restart(second)
+
+	got := <-s.restartChan
+	if paths := got.Paths(); len(paths) != 2 {
+		t.Fatalf("expected merged restart request, got %v", paths)
+	}
+}
+
+func writeFakeBuild(t *testing.T, dir string, i int) Build {
+	t.Helper()
+
+	id := "server_" + string(rune('a'+i))
+	path := filepath.Join(dir, id)
+	if err := os.WriteFile(path, []byte("bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return Build{
+		ID:      id,
+		BinPath: path,
+		BuiltAt: time.Now().Add(time.Duration(i) * time.Second),
+	}
+}
@@ -11,28 +11,53 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/config"
 	"github.com/mbvlabs/shadowfax/internal/ctxrun"
+	"github.com/mbvlabs/shadowfax/internal/metrics"
 	"github.com/mbvlabs/shadowfax/internal/reload"
 	"github.com/mbvlabs/shadowfax/internal/state"
 )
 
+// maxBannerFiles caps the changed files listed when a rebuild starts.
+const maxBannerFiles = 10
+
 type AppServer struct {
 	cmd                   *exec.Cmd
 	buildCmd              string
 	binPath               string
 	binDir                string
-	prevBinPath           string
+	root                  string
 	appPort               string
 	broadcaster           *reload.Broadcaster
 	addProcess            func(*exec.Cmd)
 	readyChan             chan<- struct{}
 	onRebuildStateChanged func(bool)
+	onRebuild             func(changes.Set)
 	stateTracker          *state.Tracker
 	clearLogs             func()
 	healthMu              sync.Mutex
 	healthCancel          context.CancelFunc
 	buildRunner           *ctxrun.Runner
 	cmdMu                 sync.Mutex
+	history               *buildHistory
+	rollbackChan          chan Build
+	restartChan           chan changes.Set
+	metrics               *metrics.Recorder
+	cycle                 *metrics.Cycle
+	env                   func(buildID string) ([]string, error)
+	beforeStart           func(ctx context.Context) error
+	buildBinary           func(ctx context.Context, binPath string) error
+
+	// runMu guards the state of the rebuild in flight. Restarts requested
+	// while it runs are queued instead of canceling it.
+	runMu         sync.Mutex
+	buildGen      uint64
+	building      bool
+	queuedRestart *changes.Set
+	// unbuilt holds the changes of the rebuild in flight, or of one a
+	// rollback canceled, which the next rebuild takes over.
+	unbuilt changes.Set
 }
 
 type Config struct {
@@ -41,8 +66,22 @@ type Config struct {
 	AddProcess            func(*exec.Cmd)
 	ReadyChan             chan<- struct{}
 	OnRebuildStateChanged func(bool)
-	StateTracker          *state.Tracker
-	ClearLogs             func()
+	// OnRebuild is called with the change set that triggered a rebuild,
+	// before the build starts.
+	OnRebuild    func(changes.Set)
+	StateTracker *state.Tracker
+	ClearLogs    func()
+	// KeepBuilds is how many successful binaries stay in tmp/bin for
+	// rollback. Zero means DefaultKeepBuilds.
+	KeepBuilds int
+	// Metrics receives per-stage timings of every rebuild cycle.
+	Metrics *metrics.Recorder
+	// Env returns the environment overrides for the app process started
+	// from the given build. Nil means TEMPL_DEV_MODE=true only.
+	Env func(buildID string) ([]string, error)
+	// BeforeStart runs before every app start, while the previous process
+	// is still running. An error keeps the new build from starting.
+	BeforeStart func(ctx context.Context) error
 }
 
 func (s *AppServer) makeBinaryPath() string {
@@ -54,38 +93,91 @@ func NewAppServer(cfg Config) *AppServer {
 	binDir := wd + "/tmp/bin"
 	return &AppServer{
 		buildCmd:              "go build -o tmp/bin/main cmd/app/main.go",
-		binPath:               filepath.Join(binDir, "server_"+strconv.FormatInt(time.Now().UnixNano(), 16)),
 		binDir:                binDir,
+		root:                  wd,
 		appPort:               cfg.AppPort,
 		broadcaster:           cfg.Broadcaster,
 		addProcess:            cfg.AddProcess,
 		readyChan:             cfg.ReadyChan,
 		onRebuildStateChanged: cfg.OnRebuildStateChanged,
+		onRebuild:             cfg.OnRebuild,
 		stateTracker:          cfg.StateTracker,
 		clearLogs:             cfg.ClearLogs,
 		buildRunner:           ctxrun.New(),
+		history:               newBuildHistory(binDir, cfg.KeepBuilds),
+		rollbackChan:          make(chan Build, 1),
+		restartChan:           make(chan changes.Set, 1),
+		metrics:               cfg.Metrics,
+		env:                   cfg.Env,
+		beforeStart:           cfg.BeforeStart,
+		buildBinary:           goBuild,
 	}
 }
 
-func (s *AppServer) Run(ctx context.Context, rebuildChan <-chan struct{}) error {
+func goBuild(ctx context.Context, binPath string) error {
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", binPath, "cmd/app/main.go")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (s *AppServer) Run(ctx context.Context, rebuildChan <-chan changes.Set) error {
+	s.history.load()
+
 	s.setRebuildState(true)
-	s.buildRunner.Go(ctx, func(buildCtx context.Context) {
-		if err := s.rebuild(buildCtx, ctx); err != nil {
-			fmt.Printf("[shadowfax] Initial build failed: %v\n", err)
-			s.setRebuildState(false)
-		}
-	})
+	s.startRebuild(ctx, changes.Set{}, "Initial build failed")
 
 	for {
 		select {
 		case <-ctx.Done():
 			s.cancelHealthMonitor()
 			return nil
-		case <-rebuildChan:
+		case set := <-rebuildChan:
+			if s.onRebuild != nil {
+				s.onRebuild(set)
+			}
 			s.setRebuildState(true)
-			s.buildRunner.Go(ctx, func(buildCtx context.Context) {
-				if err := s.rebuild(buildCtx, ctx); err != nil {
-					fmt.Printf("[shadowfax] Build failed: %v\n", err)
+			s.startRebuild(ctx, set, "Build failed")
+		case set := <-s.restartChan:
+			if s.queueRestart(set) {
+				continue
+			}
+			s.cmdMu.Lock()
+			binPath := s.binPath
+			s.cmdMu.Unlock()
+			s.setRebuildState(true)
+			if binPath == "" {
+				// Nothing is running yet, so build instead.
+				s.startRebuild(ctx, set, "Restart failed")
+				continue
+			}
+			s.buildRunner.Go(ctx, func(runCtx context.Context) {
+				if runCtx.Err() != nil {
+					return
+				}
+				fmt.Println("[shadowfax] Restarting server...")
+				if err := s.start(ctx, binPath, s.metrics.Begin(set), true); err != nil {
+					fmt.Printf("[shadowfax] Restart failed: %v\n", err)
+					s.setRebuildState(false)
+				}
+			})
+		case build := <-s.rollbackChan:
+			s.setRebuildState(true)
+			if pending := s.cancelRebuild(); len(pending.Files) > 0 || pending.Reason != "" {
+				fmt.Println("[shadowfax] Rollback canceled the build in progress; its changes are built with the next change:")
+				for _, line := range pending.Relative(s.root).Lines(maxBannerFiles) {
+					fmt.Println("[shadowfax] " + line)
+				}
+			}
+			s.buildRunner.Go(ctx, func(runCtx context.Context) {
+				if runCtx.Err() != nil {
+					return
+				}
+				fmt.Printf("[shadowfax] Rolling back to build %s (%s)\n", build.ID, describeBuild(build))
+				// Pending migrations are meant for newer code, not the build
+				// being rolled back to.
+				if err := s.start(ctx, build.BinPath, s.metrics.Begin(changes.Set{Reason: "rollback to " + build.ID}), false); err != nil {
+					fmt.Printf("[shadowfax] Rollback failed: %v\n", err)
 					s.setRebuildState(false)
 				}
 			})
@@ -93,34 +185,153 @@ func (s *AppServer) Run(ctx context.Context, rebuildChan <-chan struct{}) error
 	}
 }
 
-func (s *AppServer) rebuild(buildCtx context.Context, appCtx context.Context) error {
-	s.prevBinPath = s.binPath
-	s.binPath = s.makeBinaryPath()
+// startRebuild builds and starts the app, canceling a rebuild still in
+// flight. The changes of a canceled rebuild are built along with set.
+func (s *AppServer) startRebuild(ctx context.Context, set changes.Set, failure string) {
+	s.runMu.Lock()
+	set = s.unbuilt.Merge(set)
+	s.unbuilt = set
+	s.buildGen++
+	gen := s.buildGen
+	s.building = true
+	s.runMu.Unlock()
+
+	s.buildRunner.Go(ctx, func(buildCtx context.Context) {
+		err := s.rebuild(buildCtx, ctx, set)
+		if buildCtx.Err() != nil {
+			// A newer rebuild took over.
+			return
+		}
+		if err != nil {
+			fmt.Printf("[shadowfax] %s: %v\n", failure, err)
+			s.setRebuildState(false)
+		}
+		s.finishRebuild(gen)
+	})
+}
+
+// cancelRebuild releases the state of a rebuild in flight that another job
+// is about to cancel, so later restarts aren't held for it. The changes it
+// didn't build, including a restart queued behind it, stay pending for the
+// next rebuild and are returned.
+func (s *AppServer) cancelRebuild() changes.Set {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	if !s.building {
+		return changes.Set{}
+	}
+	s.buildGen++
+	s.building = false
+	if s.queuedRestart != nil {
+		s.unbuilt = s.unbuilt.Merge(*s.queuedRestart)
+		s.queuedRestart = nil
+	}
+	return s.unbuilt
+}
+
+// queueRestart holds a restart requested while a rebuild is in flight, so
+// it runs after the rebuild instead of canceling it. It reports false when
+// no rebuild is running.
+func (s *AppServer) queueRestart(set changes.Set) bool {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	if !s.building {
+		return false
+	}
+	if s.queuedRestart != nil {
+		set = s.queuedRestart.Merge(set)
+	}
+	s.queuedRestart = &set
+	return true
+}
+
+// finishRebuild runs a restart queued during the rebuild gen, unless the
+// rebuild started the app after it was requested.
+func (s *AppServer) finishRebuild(gen uint64) {
+	s.runMu.Lock()
+	if gen != s.buildGen {
+		s.runMu.Unlock()
+		return
+	}
+	s.building = false
+	s.unbuilt = changes.Set{}
+	restart := s.queuedRestart
+	s.queuedRestart = nil
+	s.runMu.Unlock()
+
+	if restart != nil {
+		changes.Send(s.restartChan, *restart)
+	}
+}
+
+// Rollback restarts the newest healthy build that is older than the running
+// one, without rebuilding. It returns the build that will be started.
+func (s *AppServer) Rollback() (Build, error) {
+	s.cmdMu.Lock()
+	current := s.binPath
+	s.cmdMu.Unlock()
+
+	build, ok := s.history.previous(current)
+	if !ok {
+		return Build{}, ErrNoPreviousBuild
+	}
+
+	select {
+	case s.rollbackChan <- build:
+	default:
+		return Build{}, fmt.Errorf("rollback already pending")
+	}
+	return build, nil
+}
+
+// Restart restarts the running build without rebuilding, or builds when
+// nothing has been built yet. Restarts requested while one is pending are
+// merged, and a restart requested during a rebuild waits for it instead of
+// canceling it.
+func (s *AppServer) Restart(set changes.Set) {
+	changes.Send(s.restartChan, set)
+}
+
+// Builds returns the retained builds, oldest first.
+func (s *AppServer) Builds() []Build {
+	return s.history.list()
+}
+
+func (s *AppServer) rebuild(buildCtx context.Context, appCtx context.Context, set changes.Set) error {
+	binPath := s.makeBinaryPath()
+	set = set.Relative(s.root)
+	cycle := s.metrics.Begin(set)
 
 	if s.clearLogs != nil {
 		s.clearLogs()
 	}
 
 	fmt.Println("[shadowfax] Building...")
+	for _, line := range set.Lines(maxBannerFiles) {
+		fmt.Println("[shadowfax] " + line)
+	}
+	if s.broadcaster != nil && (len(set.Files) > 0 || set.Reason != "") {
+		s.broadcaster.Notify(reload.RebuildMessage(set))
+	}
 
-	buildCmd := exec.CommandContext(buildCtx, "go", "build", "-o", s.binPath, "cmd/app/main.go")
-	buildCmd.Stdout = os.Stdout
-	buildCmd.Stderr = os.Stderr
-
-	if err := buildCmd.Run(); err != nil {
-		os.Remove(s.binPath)
-		s.binPath = s.prevBinPath
-		s.prevBinPath = ""
+	buildStart := time.Now()
+	if err := s.buildBinary(buildCtx, binPath); err != nil {
+		os.Remove(binPath)
+		if buildCtx.Err() != nil {
+			cycle.Finish(metrics.OutcomeCanceled)
+			return buildCtx.Err()
+		}
+		cycle.Finish(metrics.OutcomeBuildFailed)
 		if s.stateTracker != nil {
 			s.stateTracker.SetError(state.IndexGoBuild, err.Error())
 		}
 		return fmt.Errorf("build failed: %w", err)
 	}
+	cycle.Since(metrics.StageBuild, buildStart)
 
 	if buildCtx.Err() != nil {
-		os.Remove(s.binPath)
-		s.binPath = s.prevBinPath
-		s.prevBinPath = ""
+		os.Remove(binPath)
+		cycle.Finish(metrics.OutcomeCanceled)
 		return buildCtx.Err()
 	}
 
@@ -128,20 +339,64 @@ func (s *AppServer) rebuild(buildCtx context.Context, appCtx context.Context) er
 		s.stateTracker.SetError(state.IndexGoBuild, "")
 	}
 
+	s.history.add(Build{
+		ID:           filepath.Base(binPath),
+		BinPath:      binPath,
+		BuiltAt:      time.Now(),
+		GitSHA:       gitHead(buildCtx),
+		ChangedFiles: set.Paths(),
+	})
+
+	return s.start(appCtx, binPath, cycle, true)
+}
+
+// start stops the running app process and launches binPath in its place.
+// BeforeStart only runs with runBeforeStart.
+func (s *AppServer) start(appCtx context.Context, binPath string, cycle *metrics.Cycle, runBeforeStart bool) error {
+	env := []string{"TEMPL_DEV_MODE=true"}
+	if s.env != nil {
+		var err error
+		if env, err = s.env(filepath.Base(binPath)); err != nil {
+			cycle.Finish(metrics.OutcomeStartFailed)
+			return fmt.Errorf("resolving app env: %w", err)
+		}
+	}
+
+	// A fresh process satisfies restarts queued until now.
+	s.runMu.Lock()
+	s.queuedRestart = nil
+	s.runMu.Unlock()
+
+	if s.beforeStart != nil && runBeforeStart {
+		beforeStartBegin := time.Now()
+		if err := s.beforeStart(appCtx); err != nil {
+			cycle.Finish(metrics.OutcomeStartFailed)
+			return err
+		}
+		cycle.Since(metrics.StageBeforeStart, beforeStartBegin)
+	}
+
+	stopBegin := time.Now()
 	s.stop()
+	cycle.Since(metrics.StageStop, stopBegin)
 
 	fmt.Println("[shadowfax] Starting server...")
+	startBegin := time.Now()
 	s.cmdMu.Lock()
-	s.cmd = exec.CommandContext(appCtx, s.binPath)
-	s.cmd.Env = append(os.Environ(), "TEMPL_DEV_MODE=true")
+	s.binPath = binPath
+	s.cycle = cycle
+	s.cmd = exec.CommandContext(appCtx, binPath)
+	s.cmd.Env = config.MergeEnv(os.Environ(), env)
 	s.cmd.Stdout = os.Stdout
 	s.cmd.Stderr = os.Stderr
 
 	if err := s.cmd.Start(); err != nil {
 		s.cmdMu.Unlock()
+		cycle.Finish(metrics.OutcomeStartFailed)
 		return fmt.Errorf("start failed: %w", err)
 	}
 	s.cmdMu.Unlock()
+	cycle.Since(metrics.StageStart, startBegin)
 
 	if s.addProcess != nil {
 		s.addProcess(s.cmd)
@@ -176,15 +431,32 @@ func (s *AppServer) startHealthMonitor(ctx context.Context) {
 	s.healthCancel = cancel
 	s.healthMu.Unlock()
 
+	s.cmdMu.Lock()
+	binPath := s.binPath
+	cycle := s.cycle
+	s.cmdMu.Unlock()
+
 	go func() {
 		healthURL := fmt.Sprintf("http://localhost:%s/", s.appPort)
-		reload.BroadcastWhenHealthy(healthCtx, healthURL, s.broadcaster)
+		waitStart := time.Now()
+		err := reload.WaitForServer(healthCtx, healthURL)
 		if healthCtx.Err() != nil {
+			cycle.Finish(metrics.OutcomeCanceled)
 			return
 		}
-		if s.prevBinPath != "" {
-			os.Remove(s.prevBinPath)
-			s.prevBinPath = ""
+		if err != nil {
+			fmt.Printf("[shadowfax] Server health check timed out: %v\n", err)
+			cycle.Finish(metrics.OutcomeUnhealthy)
+		} else {
+			cycle.Since(metrics.StageHealthy, waitStart)
+			broadcastStart := time.Now()
+			s.broadcaster.Broadcast()
+			cycle.Since(metrics.StageBroadcast, broadcastStart)
+			fmt.Println("[shadowfax] Server healthy, broadcasting reload")
+			cycle.Finish(metrics.OutcomeOK)
+			if s.history != nil {
+				s.history.markHealthy(binPath)
+			}
 		}
 		s.setRebuildState(false)
 		if s.readyChan != nil {
@@ -211,3 +483,11 @@ func (s *AppServer) setRebuildState(inProgress bool) {
 		s.onRebuildStateChanged(inProgress)
 	}
 }
+
+func describeBuild(b Build) string {
+	desc := "built " + b.BuiltAt.Format("15:04:05")
+	if b.GitSHA != "" {
+		desc += " at " + b.GitSHA
+	}
+	return desc
+}
@@ -2,13 +2,19 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/metrics"
 	"github.com/mbvlabs/shadowfax/internal/reload"
 )
 
@@ -42,6 +48,76 @@ func TestSetRebuildStateInvokesCallback(t *testing.T) {
 	}
 }
 
+func TestBeforeStartErrorKeepsBuildFromStarting(t *testing.T) {
+	s := NewAppServer(Config{
+		BeforeStart: func(context.Context) error { return errors.New("migrations failed") },
+	})
+	s.binPath = "tmp/bin/server_old"
+
+	err := s.start(context.Background(), "tmp/bin/server_new", nil, true)
+	if err == nil || err.Error() != "migrations failed" {
+		t.Fatalf("expected BeforeStart error, got %v", err)
+	}
+	if s.binPath != "tmp/bin/server_old" || s.cmd != nil {
+		t.Fatal("expected the new build not to start")
+	}
+}
+
+func TestRollbackSkipsBeforeStart(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var ran atomic.Bool
+	s := NewAppServer(Config{
+		AppPort:     getUnusedPort(t),
+		BeforeStart: func(context.Context) error { ran.Store(true); return nil },
+	})
+	binPath := filepath.Join(t.TempDir(), "server_old")
+	if err := os.WriteFile(binPath, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := s.start(ctx, binPath, nil, false); err != nil {
+		t.Fatalf("start returned error: %v", err)
+	}
+	defer s.stop()
+	if ran.Load() {
+		t.Fatal("expected BeforeStart to be skipped for a rollback")
+	}
+}
+
+func TestStartTimesStagesSeparately(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s := NewAppServer(Config{
+		AppPort: getUnusedPort(t),
+		BeforeStart: func(context.Context) error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		},
+	})
+	binPath := filepath.Join(t.TempDir(), "server_new")
+	if err := os.WriteFile(binPath, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cycle := metrics.NewRecorder(10).Begin(changes.Set{})
+	if err := s.start(ctx, binPath, cycle, true); err != nil {
+		t.Fatalf("start returned error: %v", err)
+	}
+	defer s.stop()
+	if d := cycle.Stages[metrics.StageBeforeStart]; d < 100*time.Millisecond {
+		t.Fatalf("expected BeforeStart to be timed as its own stage, got %s", d)
+	}
+	if _, ok := cycle.Stages[metrics.StageStop]; !ok {
+		t.Fatal("expected a stop stage")
+	}
+	if d := cycle.Stages[metrics.StageStart]; d >= 100*time.Millisecond {
+		t.Fatalf("expected the start stage to exclude BeforeStart, got %s", d)
+	}
+}
+
 func TestStartHealthMonitorSignalsReadyAndClearsRebuildState(t *testing.T) {
 	port, closeServer := startHealthyServer(t)
 	defer closeServer()
@@ -161,3 +237,235 @@ func getUnusedPort(t *testing.T) string {
 	_ = ln.Close()
 	return port
 }
+
+func TestRestartDuringRebuildIsQueued(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	type buildCall struct {
+		binPath string
+		result  chan error
+	}
+	builds := make(chan buildCall)
+	starts := make(chan string, 4)
+	s := NewAppServer(Config{
+		AppPort:    getUnusedPort(t),
+		AddProcess: func(cmd *exec.Cmd) { starts <- cmd.Path },
+	})
+	s.buildBinary = func(ctx context.Context, binPath string) error {
+		call := buildCall{binPath: binPath, result: make(chan error)}
+		builds <- call
+		err := <-call.result
+		if ctx.Err() != nil {
+			t.Errorf("expected the rebuild of %s not to be canceled", binPath)
+		}
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(filepath.Dir(binPath), 0o755)
+		return os.WriteFile(binPath, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rebuildChan := make(chan changes.Set)
+	go s.Run(ctx, rebuildChan)
+
+	// A restart requested before the new build starts is satisfied by it.
+	first := <-builds
+	s.Restart(changes.Set{Reason: "migrations changed"})
+	time.Sleep(100 * time.Millisecond)
+	first.result <- nil
+	if got := <-starts; got != first.binPath {
+		t.Fatalf("expected the new build to start, got %s", got)
+	}
+	select {
+	case got := <-starts:
+		t.Fatalf("expected no extra restart, got %s", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// When the rebuild fails, the queued restart restarts the running build.
+	rebuildChan <- changes.Set{Reason: "edit"}
+	second := <-builds
+	s.Restart(changes.Set{Reason: "migrations changed"})
+	time.Sleep(100 * time.Millisecond)
+	second.result <- errors.New("compile error")
+	select {
+	case got := <-starts:
+		if got != first.binPath {
+			t.Fatalf("expected the running build to restart, got %s", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the queued restart to run after the failed rebuild")
+	}
+}
+
+// changedFiles returns the changed files of the newest build that has any.
+// A canceled build can still be recorded after a newer one.
+func changedFiles(builds []Build) []string {
+	for i := len(builds) - 1; i >= 0; i-- {
+		if len(builds[i].ChangedFiles) > 0 {
+			return builds[i].ChangedFiles
+		}
+	}
+	return nil
+}
+
+func TestCanceledRebuildChangesCarryOver(t *testing.T) {
+	root := t.TempDir()
+	t.Chdir(root)
+	root, _ = os.Getwd()
+
+	builds := make(chan chan error)
+	s := NewAppServer(Config{AppPort: getUnusedPort(t)})
+	s.buildBinary = func(ctx context.Context, binPath string) error {
+		result := make(chan error)
+		builds <- result
+		select {
+		case err := <-result:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		os.MkdirAll(filepath.Dir(binPath), 0o755)
+		return os.WriteFile(binPath, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rebuildChan := make(chan changes.Set)
+	go s.Run(ctx, rebuildChan)
+	defer s.stop()
+	(<-builds) <- nil
+
+	var a, b changes.Set
+	a.Add(filepath.Join(root, "a.go"), changes.OpWrite)
+	b.Add(filepath.Join(root, "b.go"), changes.OpWrite)
+	rebuildChan <- a
+	<-builds
+	rebuildChan <- b
+	(<-builds) <- nil
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if got := changedFiles(s.Builds()); got != nil {
+			if len(got) != 2 || got[0] != "a.go" || got[1] != "b.go" {
+				t.Fatalf("expected the canceled rebuild's changes to carry over, got %v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rebuild to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRollbackDuringRebuildReleasesRestarts(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	starts := make(chan string, 4)
+	s := NewAppServer(Config{
+		AppPort:    getUnusedPort(t),
+		AddProcess: func(cmd *exec.Cmd) { starts <- cmd.Path },
+	})
+	old := filepath.Join(s.binDir, "server_old")
+	os.MkdirAll(s.binDir, 0o755)
+	if err := os.WriteFile(old, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s.history.add(Build{ID: "server_old", BinPath: old, BuiltAt: time.Now(), Healthy: true})
+
+	building := make(chan struct{})
+	s.buildBinary = func(ctx context.Context, binPath string) error {
+		close(building)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, make(chan changes.Set))
+	defer s.stop()
+
+	<-building
+	if _, err := s.Rollback(); err != nil {
+		t.Fatalf("Rollback returned error: %v", err)
+	}
+	if got := <-starts; got != old {
+		t.Fatalf("expected the rollback to start %s, got %s", old, got)
+	}
+
+	s.Restart(changes.Set{Reason: "migrations changed"})
+	select {
+	case got := <-starts:
+		if got != old {
+			t.Fatalf("expected the restart to start %s, got %s", old, got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the restart to run after the rollback canceled the rebuild")
+	}
+}
+
+func TestRollbackKeepsChangesOfCanceledRebuild(t *testing.T) {
+	root := t.TempDir()
+	t.Chdir(root)
+	root, _ = os.Getwd()
+
+	s := NewAppServer(Config{AppPort: getUnusedPort(t)})
+	old := filepath.Join(s.binDir, "server_old")
+	os.MkdirAll(s.binDir, 0o755)
+	if err := os.WriteFile(old, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s.history.add(Build{ID: "server_old", BinPath: old, BuiltAt: time.Now().Add(-time.Minute), Healthy: true})
+
+	builds := make(chan chan error)
+	s.buildBinary = func(ctx context.Context, binPath string) error {
+		result := make(chan error)
+		builds <- result
+		select {
+		case err := <-result:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return os.WriteFile(binPath, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rebuildChan := make(chan changes.Set)
+	go s.Run(ctx, rebuildChan)
+	defer s.stop()
+	(<-builds) <- nil
+
+	var a, b changes.Set
+	a.Add(filepath.Join(root, "a.go"), changes.OpWrite)
+	b.Add(filepath.Join(root, "b.go"), changes.OpWrite)
+	rebuildChan <- a
+	<-builds
+	if _, err := s.Rollback(); err != nil {
+		t.Fatalf("Rollback returned error: %v", err)
+	}
+	rebuildChan <- b
+	(<-builds) <- nil
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if got := changedFiles(s.Builds()); got != nil {
+			if len(got) != 2 || got[0] != "a.go" || got[1] != "b.go" {
+				t.Fatalf("expected the changes canceled by the rollback to be built, got %v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rebuild to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
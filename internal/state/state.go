@@ -3,23 +3,67 @@ package state
 import "sync"
 
 const (
-	IndexTempl   = 0
-	IndexGoBuild = 1
+	IndexTempl      = 0
+	IndexGoBuild    = 1
+	IndexTests      = 2
+	IndexAssets     = 3
+	IndexMigrations = 4
 )
 
+var builtinNames = []string{"templ", "go build", "tests", "assets", "migrations"}
+
+// Error is a non-empty error message together with the stage it belongs to.
+type Error struct {
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
 type Tracker struct {
-	mu      sync.Mutex
-	errMsgs [2]string
+	mu       sync.Mutex
+	names    []string
+	errMsgs  []string
+	onChange func()
 }
 
 func New() *Tracker {
-	return &Tracker{}
+	return &Tracker{
+		names:   append([]string(nil), builtinNames...),
+		errMsgs: make([]string, len(builtinNames)),
+	}
 }
 
-func (t *Tracker) SetError(index int, msg string) {
+// Index returns the index of the named error source, registering it after
+// the built-in ones on first use.
+func (t *Tracker) Index(name string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, n := range t.names {
+		if n == name {
+			return i
+		}
+	}
+	t.names = append(t.names, name)
+	t.errMsgs = append(t.errMsgs, "")
+	return len(t.names) - 1
+}
+
+// OnChange registers fn to be called whenever an error message changes.
+func (t *Tracker) OnChange(fn func()) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.onChange = fn
+}
+
+func (t *Tracker) SetError(index int, msg string) {
+	t.mu.Lock()
+	changed := t.errMsgs[index] != msg
 	t.errMsgs[index] = msg
+	onChange := t.onChange
+	t.mu.Unlock()
+
+	if changed && onChange != nil {
+		onChange()
+	}
 }
 
 func (t *Tracker) HasError() bool {
@@ -44,3 +88,16 @@ func (t *Tracker) ErrorAt(index int) string {
 	defer t.mu.Unlock()
 	return t.errMsgs[index]
 }
+
+// Errors returns all current error messages in index order.
+func (t *Tracker) Errors() []Error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []Error
+	for i, msg := range t.errMsgs {
+		if msg != "" {
+			errs = append(errs, Error{Source: t.names[i], Message: msg})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,47 @@
+package state
+
+import "testing"
+
+func TestSetErrorNotifiesOnlyOnChange(t *testing.T) {
+	trk := New()
+	calls := 0
+	trk.OnChange(func() { calls++ })
+
+	trk.SetError(IndexGoBuild, "exit status 1")
+	trk.SetError(IndexGoBuild, "exit status 1")
+	trk.SetError(IndexGoBuild, "")
+
+	if calls != 2 {
+		t.Fatalf("expected 2 change notifications, got %d", calls)
+	}
+}
+
+func TestErrorsListsSources(t *testing.T) {
+	trk := New()
+	trk.SetError(IndexTests, "FAIL example.com/app/users")
+	trk.SetError(IndexTempl, "(✗) parse error")
+
+	errs := trk.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %d", len(errs))
+	}
+	if errs[0].Source != "templ" || errs[1].Source != "tests" {
+		t.Fatalf("unexpected error order: %+v", errs)
+	}
+}
+
+func TestIndexRegistersSources(t *testing.T) {
+	trk := New()
+	if trk.Index("templ") != IndexTempl {
+		t.Fatal("expected built-in source to keep its index")
+	}
+
+	lint := trk.Index("lint")
+	if lint != trk.Index("lint") || lint <= IndexMigrations {
+		t.Fatalf("unexpected index for custom source: %d", lint)
+	}
+	trk.SetError(lint, "unused variable")
+	if errs := trk.Errors(); len(errs) != 1 || errs[0].Source != "lint" {
+		t.Fatalf("unexpected errors: %+v", errs)
+	}
+}
@@ -0,0 +1,428 @@
+package testrun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/ctxrun"
+	"github.com/mbvlabs/shadowfax/internal/state"
+)
+
+// maxFailureLines caps the output kept per failing test.
+const maxFailureLines = 20
+
+// Package is the subset of `go list -json` output needed to find the
+// packages affected by a change.
+type Package struct {
+	ImportPath   string
+	Dir          string
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+type Config struct {
+	// Dir is the module root. Defaults to the working directory.
+	Dir          string
+	Verbose      bool
+	StateTracker *state.Tracker
+	AddProcess   func(*exec.Cmd)
+	Out          io.Writer
+}
+
+// Runner runs `go test` for the packages affected by changed files. A new
+// Trigger cancels the run in progress and takes over its files.
+type Runner struct {
+	cfg    Config
+	runner *ctxrun.Runner
+
+	mu       sync.Mutex
+	failures map[string]string
+	// untested holds the files of runs that haven't finished yet.
+	untested []string
+}
+
+func New(cfg Config) *Runner {
+	if cfg.Dir == "" {
+		cfg.Dir, _ = os.Getwd()
+	}
+	if cfg.Out == nil {
+		cfg.Out = os.Stdout
+	}
+	return &Runner{
+		cfg:      cfg,
+		runner:   ctxrun.New(),
+		failures: make(map[string]string),
+	}
+}
+
+// Trigger starts a test run for the packages affected by files, cancelling
+// any run still in progress. The new run also covers the files of the
+// canceled one.
+func (r *Runner) Trigger(ctx context.Context, files []string) {
+	if len(files) == 0 {
+		return
+	}
+	r.mu.Lock()
+	for _, f := range files {
+		if !slices.Contains(r.untested, f) {
+			r.untested = append(r.untested, f)
+		}
+	}
+	files = slices.Clone(r.untested)
+	r.mu.Unlock()
+
+	r.runner.Go(ctx, func(runCtx context.Context) {
+		err := r.run(runCtx, files)
+		if runCtx.Err() != nil {
+			return
+		}
+		r.mu.Lock()
+		r.untested = slices.DeleteFunc(r.untested, func(f string) bool {
+			return slices.Contains(files, f)
+		})
+		r.mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(r.cfg.Out, "[test] %v\n", err)
+		}
+	})
+}
+
+func (r *Runner) run(ctx context.Context, files []string) error {
+	pkgs, err := listPackages(ctx, r.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("listing packages: %w", err)
+	}
+
+	affected := AffectedPackages(pkgs, files)
+	if len(affected) == 0 {
+		if r.cfg.Verbose {
+			fmt.Fprintln(r.cfg.Out, "[test] No packages affected")
+		}
+		return nil
+	}
+
+	fmt.Fprintf(r.cfg.Out, "[test] Running tests for %d package(s)\n", len(affected))
+
+	args := append([]string{"test", "-json"}, affected...)
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = r.cfg.Dir
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting go test: %w", err)
+	}
+	if r.cfg.AddProcess != nil {
+		r.cfg.AddProcess(cmd)
+	}
+
+	results := parseTestEvents(stdout, func(res PackageResult) {
+		fmt.Fprint(r.cfg.Out, res.Compact())
+	})
+	waitErr := cmd.Wait()
+
+	if ctx.Err() != nil {
+		if r.cfg.Verbose {
+			fmt.Fprintln(r.cfg.Out, "[test] Run canceled by a newer change")
+		}
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		return fmt.Errorf("go test: %w", waitErr)
+	}
+	if len(results) == 0 && waitErr != nil {
+		results = append(results, PackageResult{
+			ImportPath: strings.Join(affected, " "),
+			Failed:     true,
+			Output:     strings.Split(strings.TrimSpace(stderr.String()), "\n"),
+		})
+		fmt.Fprint(r.cfg.Out, results[0].Compact())
+	}
+
+	r.record(results)
+	return nil
+}
+
+// record updates the known failures with the packages from the latest run
+// and publishes them to the state tracker.
+func (r *Runner) record(results []PackageResult) {
+	r.mu.Lock()
+	for _, res := range results {
+		if res.Failed {
+			r.failures[res.ImportPath] = res.Summary()
+		} else {
+			delete(r.failures, res.ImportPath)
+		}
+	}
+	keys := make([]string, 0, len(r.failures))
+	for k := range r.failures {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var msg strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			msg.WriteString("\n")
+		}
+		msg.WriteString(r.failures[k])
+	}
+	failing := len(keys)
+	r.mu.Unlock()
+
+	if failing == 0 {
+		fmt.Fprintln(r.cfg.Out, "[test] All affected packages pass")
+	} else {
+		fmt.Fprintf(r.cfg.Out, "[test] %d package(s) failing\n", failing)
+	}
+
+	if r.cfg.StateTracker != nil {
+		r.cfg.StateTracker.SetError(state.IndexTests, msg.String())
+	}
+}
+
+func listPackages(ctx context.Context, dir string) ([]Package, error) {
+	cmd := exec.CommandContext(ctx, "go", "list", "-e", "-json=ImportPath,Dir,Imports,TestImports,XTestImports", "./...")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []Package
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var p Package
+		if err := dec.Decode(&p); err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+// AffectedPackages returns the import paths of the packages containing files
+// plus every package in pkgs that depends on them, directly or transitively.
+// A go.mod or go.sum change affects every package.
+// Packages that only reference a changed package from their tests are
+// included, but their own dependents are not.
+func AffectedPackages(pkgs []Package, files []string) []string {
+	byDir := make(map[string]string, len(pkgs))
+	importers := make(map[string][]string)
+	testImporters := make(map[string][]string)
+	for _, p := range pkgs {
+		byDir[filepath.Clean(p.Dir)] = p.ImportPath
+		for _, imp := range p.Imports {
+			importers[imp] = append(importers[imp], p.ImportPath)
+		}
+		for _, imp := range append(append([]string{}, p.TestImports...), p.XTestImports...) {
+			testImporters[imp] = append(testImporters[imp], p.ImportPath)
+		}
+	}
+
+	affected := make(map[string]bool)
+	var queue []string
+	for _, f := range files {
+		switch filepath.Base(f) {
+		case "go.mod", "go.sum", "go.work", "go.work.sum":
+			for _, p := range pkgs {
+				affected[p.ImportPath] = true
+			}
+			continue
+		}
+
+		// Embedded files can live in subdirectories of their package, so use
+		// the closest enclosing package.
+		for dir := filepath.Dir(filepath.Clean(f)); ; dir = filepath.Dir(dir) {
+			if pkg, ok := byDir[dir]; ok {
+				if !affected[pkg] {
+					affected[pkg] = true
+					queue = append(queue, pkg)
+				}
+				break
+			}
+			if parent := filepath.Dir(dir); parent == dir {
+				break
+			}
+		}
+	}
+
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, importer := range importers[pkg] {
+			if !affected[importer] {
+				affected[importer] = true
+				queue = append(queue, importer)
+			}
+		}
+	}
+
+	for pkg := range affected {
+		for _, importer := range testImporters[pkg] {
+			affected[importer] = true
+		}
+	}
+
+	out := make([]string, 0, len(affected))
+	for pkg := range affected {
+		out = append(out, pkg)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// testEvent mirrors the JSON emitted by `go test -json`.
+type testEvent struct {
+	Action     string
+	Package    string
+	ImportPath string
+	Test       string
+	Elapsed    float64
+	Output     string
+	// FailedBuild names the package whose build failed, if any.
+	FailedBuild string
+}
+
+// PackageResult is the outcome of one package in a test run.
+type PackageResult struct {
+	ImportPath  string
+	Failed      bool
+	Elapsed     time.Duration
+	FailedTests []string
+	Output      []string
+}
+
+// Compact renders the one-line (plus failure details) form printed while
+// tests stream.
+func (p PackageResult) Compact() string {
+	var b strings.Builder
+	if !p.Failed {
+		fmt.Fprintf(&b, "[test] ok   %s (%.2fs)\n", p.ImportPath, p.Elapsed.Seconds())
+		return b.String()
+	}
+	fmt.Fprintf(&b, "[test] FAIL %s (%.2fs)\n", p.ImportPath, p.Elapsed.Seconds())
+	for _, line := range p.Output {
+		fmt.Fprintf(&b, "[test]      %s\n", line)
+	}
+	return b.String()
+}
+
+// Summary is the failure text stored in the state tracker.
+func (p PackageResult) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FAIL %s", p.ImportPath)
+	if len(p.FailedTests) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(p.FailedTests, ", "))
+	}
+	for _, line := range p.Output {
+		b.WriteString("\n  ")
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// parseTestEvents reads `go test -json` output and calls onPackage as each
+// package finishes.
+func parseTestEvents(r io.Reader, onPackage func(PackageResult)) []PackageResult {
+	type pending struct {
+		res        PackageResult
+		testOutput map[string][]string
+		buildLines []string
+	}
+	byPkg := make(map[string]*pending)
+	get := func(pkg string) *pending {
+		p, ok := byPkg[pkg]
+		if !ok {
+			p = &pending{res: PackageResult{ImportPath: pkg}, testOutput: make(map[string][]string)}
+			byPkg[pkg] = p
+		}
+		return p
+	}
+
+	var results []PackageResult
+	dec := json.NewDecoder(r)
+	for {
+		var ev testEvent
+		if err := dec.Decode(&ev); err != nil {
+			break
+		}
+
+		switch ev.Action {
+		case "build-output":
+			p := get(ev.ImportPath)
+			p.buildLines = append(p.buildLines, strings.TrimRight(ev.Output, "\n"))
+			continue
+		case "build-fail":
+			continue
+		}
+
+		if ev.Package == "" {
+			continue
+		}
+		p := get(ev.Package)
+
+		if ev.Test != "" {
+			switch ev.Action {
+			case "output":
+				line := strings.TrimSpace(ev.Output)
+				if line == "" || strings.HasPrefix(line, "=== ") || strings.HasPrefix(line, "--- ") {
+					continue
+				}
+				if len(p.testOutput[ev.Test]) < maxFailureLines {
+					p.testOutput[ev.Test] = append(p.testOutput[ev.Test], line)
+				}
+			case "fail":
+				p.res.FailedTests = append(p.res.FailedTests, ev.Test)
+				p.res.Output = append(p.res.Output, p.testOutput[ev.Test]...)
+			}
+			continue
+		}
+
+		switch ev.Action {
+		case "output":
+			line := strings.TrimRight(ev.Output, "\n")
+			if strings.HasPrefix(line, "FAIL") || strings.HasPrefix(line, "ok") || strings.TrimSpace(line) == "" {
+				continue
+			}
+			if len(p.res.FailedTests) == 0 && len(p.buildLines) < maxFailureLines {
+				p.buildLines = append(p.buildLines, line)
+			}
+		case "pass", "fail":
+			p.res.Failed = ev.Action == "fail"
+			p.res.Elapsed = time.Duration(ev.Elapsed * float64(time.Second))
+			if ev.FailedBuild != "" {
+				if b, ok := byPkg[ev.FailedBuild]; ok {
+					p.res.Output = append(p.res.Output, b.buildLines...)
+					delete(byPkg, ev.FailedBuild)
+				}
+			} else if p.res.Failed && len(p.res.FailedTests) == 0 {
+				p.res.Output = append(p.res.Output, p.buildLines...)
+			}
+			results = append(results, p.res)
+			if onPackage != nil {
+				onPackage(p.res)
+			}
+			delete(byPkg, ev.Package)
+		}
+	}
+	return results
+}
@@ -0,0 +1,170 @@
+package testrun
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAffectedPackagesFollowsReverseDependencies(t *testing.T) {
+	pkgs := []Package{
+		{ImportPath: "example.com/app/models", Dir: "/app/models"},
+		{ImportPath: "example.com/app/services", Dir: "/app/services", Imports: []string{"example.com/app/models"}},
+		{ImportPath: "example.com/app/controllers", Dir: "/app/controllers", Imports: []string{"example.com/app/services"}},
+		{ImportPath: "example.com/app/fixtures", Dir: "/app/fixtures", TestImports: []string{"example.com/app/services"}},
+		{ImportPath: "example.com/app/router", Dir: "/app/router", Imports: []string{"example.com/app/fixtures"}},
+		{ImportPath: "example.com/app/views", Dir: "/app/views"},
+	}
+
+	got := AffectedPackages(pkgs, []string{"/app/models/user.go"})
+	want := []string{
+		"example.com/app/controllers",
+		"example.com/app/fixtures",
+		"example.com/app/models",
+		"example.com/app/services",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("AffectedPackages() = %v, want %v", got, want)
+	}
+}
+
+func TestAffectedPackagesEmbeddedAndModuleFiles(t *testing.T) {
+	pkgs := []Package{
+		{ImportPath: "example.com/app/db", Dir: "/app/db"},
+		{ImportPath: "example.com/app/web", Dir: "/app/web"},
+	}
+
+	got := AffectedPackages(pkgs, []string{"/app/db/queries/users.sql"})
+	if strings.Join(got, ",") != "example.com/app/db" {
+		t.Fatalf("expected embedded file to map to its package, got %v", got)
+	}
+
+	got = AffectedPackages(pkgs, []string{"/app/go.mod"})
+	if len(got) != 2 {
+		t.Fatalf("expected go.mod change to affect every package, got %v", got)
+	}
+}
+
+func TestAffectedPackagesIgnoresFilesOutsideModule(t *testing.T) {
+	pkgs := []Package{{ImportPath: "example.com/app", Dir: "/app"}}
+	if got := AffectedPackages(pkgs, []string{"/elsewhere/main.go"}); len(got) != 0 {
+		t.Fatalf("expected no affected packages, got %v", got)
+	}
+}
+
+const sampleEvents = `{"Action":"start","Package":"example.com/tr/a"}
+{"Action":"output","Package":"example.com/tr/a","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"output","Package":"example.com/tr/a","Test":"TestA","Output":"    a_test.go:5: boom\n"}
+{"Action":"output","Package":"example.com/tr/a","Test":"TestA","Output":"--- FAIL: TestA (0.00s)\n"}
+{"Action":"fail","Package":"example.com/tr/a","Test":"TestA","Elapsed":0}
+{"Action":"pass","Package":"example.com/tr/a","Test":"TestOK","Elapsed":0}
+{"Action":"output","Package":"example.com/tr/a","Output":"FAIL\texample.com/tr/a\t0.002s\n"}
+{"Action":"fail","Package":"example.com/tr/a","Elapsed":0.002}
+{"ImportPath":"example.com/tr/b","Action":"build-output","Output":"# example.com/tr/b\n"}
+{"ImportPath":"example.com/tr/b","Action":"build-output","Output":"b/b.go:5:17: undefined: undefined\n"}
+{"ImportPath":"example.com/tr/b","Action":"build-fail"}
+{"Action":"fail","Package":"example.com/tr/b","Elapsed":0,"FailedBuild":"example.com/tr/b"}
+{"Action":"pass","Package":"example.com/tr/c","Elapsed":0.5}
+`
+
+func TestParseTestEvents(t *testing.T) {
+	var streamed []string
+	results := parseTestEvents(strings.NewReader(sampleEvents), func(res PackageResult) {
+		streamed = append(streamed, res.ImportPath)
+	})
+
+	if len(results) != 3 || len(streamed) != 3 {
+		t.Fatalf("expected 3 package results, got %d (streamed %d)", len(results), len(streamed))
+	}
+
+	a := results[0]
+	if !a.Failed || len(a.FailedTests) != 1 || a.FailedTests[0] != "TestA" {
+		t.Fatalf("unexpected result for package a: %+v", a)
+	}
+	if len(a.Output) != 1 || a.Output[0] != "a_test.go:5: boom" {
+		t.Fatalf("expected only the failure line, got %q", a.Output)
+	}
+
+	b := results[1]
+	if !b.Failed || !strings.Contains(strings.Join(b.Output, "\n"), "undefined: undefined") {
+		t.Fatalf("expected build failure output for package b, got %+v", b)
+	}
+
+	if results[2].Failed {
+		t.Fatal("expected package c to pass")
+	}
+}
+
+func TestCompactFormat(t *testing.T) {
+	ok := PackageResult{ImportPath: "example.com/c"}
+	if got := ok.Compact(); !strings.HasPrefix(got, "[test] ok   example.com/c") {
+		t.Fatalf("unexpected pass line: %q", got)
+	}
+
+	fail := PackageResult{ImportPath: "example.com/a", Failed: true, FailedTests: []string{"TestA"}, Output: []string{"boom"}}
+	if got := fail.Summary(); got != "FAIL example.com/a (TestA)\n  boom" {
+		t.Fatalf("unexpected summary: %q", got)
+	}
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestTriggerKeepsFilesOfCanceledRun(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("go.mod", "module example.com/app\n\ngo 1.21\n")
+	a := write("a/a.go", "package a\n")
+	write("a/a_test.go", "package a\n\nimport (\n\t\"testing\"\n\t\"time\"\n)\n\nfunc TestSlow(t *testing.T) { time.Sleep(2 * time.Second) }\n")
+	b := write("b/b.go", "package b\n")
+	write("b/b_test.go", "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n")
+
+	out := &syncBuffer{}
+	r := New(Config{Dir: dir, Out: out})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r.Trigger(ctx, []string{a})
+	time.Sleep(300 * time.Millisecond)
+	r.Trigger(ctx, []string{b})
+
+	deadline := time.Now().Add(60 * time.Second)
+	for !strings.Contains(out.String(), "All affected packages pass") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the test run, output:\n%s", out)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, pkg := range []string{"example.com/app/a", "example.com/app/b"} {
+		if !strings.Contains(out.String(), "ok   "+pkg+" ") {
+			t.Fatalf("expected %s to be tested, output:\n%s", pkg, out)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
+)
+
+type AssetsConfig struct {
+	Verbose    bool
+	AddProcess func(*exec.Cmd)
+	// OnError receives the output of a failed build, or "" once a build
+	// succeeds again.
+	OnError func(msg string)
+	// Env holds KEY=VALUE overrides for the bundler.
+	Env []string
+	// Command, Watch, Done, Error, Sources and Exclude mirror
+	// config.AssetsConfig.
+	Command string
+	Watch   bool
+	Done    string
+	Error   string
+	Sources []string
+	Exclude []string
+}
+
+// AssetsBuild signals a finished asset build.
+type AssetsBuild struct {
+	// Files lists the sources that triggered a one-shot build, relative to
+	// the project root. Watch-mode bundlers don't report them.
+	Files []string
+}
+
+// defaultAssetsDone matches the success lines of common bundlers (esbuild,
+// Vite, webpack, Rollup, Bun). webpack's "compiled with N errors" is a
+// failure; only warnings still count as a build.
+var defaultAssetsDone = regexp.MustCompile(`(?i)(build finished|built in|compiled successfully|compiled with \d+ warnings? in|created .+ in|bundled .+ in|done in)`)
+
+// defaultAssetsError matches the error lines of the same bundlers.
+var defaultAssetsError = regexp.MustCompile(`(?i)(^\s*error\b|\[error\]|\berror in |error during build|compiled with \d+ errors?|build failed|failed to compile|^\s*\[!\])`)
+
+// maxAssetsErrorLines caps the error lines kept for one failed build.
+const maxAssetsErrorLines = 20
+
+var (
+	assetsDebounce = 100 * time.Millisecond
+
+	assetsRestartBackoff    = 500 * time.Millisecond
+	assetsMaxRestartBackoff = 10 * time.Second
+)
+
+// RunAssetsWatcher runs the asset bundler. In watch mode the bundler keeps
+// running and each completion line it prints is a build; otherwise the
+// command is run once at startup and again whenever a source changes.
+func RunAssetsWatcher(ctx context.Context, built chan<- AssetsBuild, cfg AssetsConfig) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if cfg.Watch {
+		return runAssetsBundler(ctx, wd, built, cfg)
+	}
+	return runAssetsOnChange(ctx, wd, built, cfg)
+}
+
+// shellCommand runs command through sh -c from dir.
+func shellCommand(ctx context.Context, dir, command string, env []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = config.MergeEnv(os.Environ(), env)
+	}
+	// Children of the shell may keep holding the output pipes after it is
+	// killed.
+	cmd.WaitDelay = 500 * time.Millisecond
+	return cmd
+}
+
+// runAssetsBundler keeps a watch-mode bundler running, restarting it with
+// backoff when it exits after having built at least once.
+func runAssetsBundler(ctx context.Context, dir string, built chan<- AssetsBuild, cfg AssetsConfig) error {
+	out := &assetsOutput{done: defaultAssetsDone, errs: defaultAssetsError, built: built, onError: cfg.OnError}
+	var err error
+	if cfg.Done != "" {
+		if out.done, err = regexp.Compile(cfg.Done); err != nil {
+			return fmt.Errorf("invalid done pattern: %w", err)
+		}
+	}
+	if cfg.Error != "" {
+		if out.errs, err = regexp.Compile(cfg.Error); err != nil {
+			return fmt.Errorf("invalid error pattern: %w", err)
+		}
+	}
+
+	backoff := assetsRestartBackoff
+	for {
+		ok, err := runAssetsProcess(ctx, dir, out, cfg)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("asset bundler exited")
+			}
+			return err
+		}
+
+		fmt.Printf("[shadowfax] Asset bundler exited (%v), restarting in %s\n", err, backoff)
+		out.fail(fmt.Sprintf("asset bundler exited (%v)", err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, assetsMaxRestartBackoff)
+	}
+}
+
+// runAssetsProcess runs the bundler until it exits and reports whether it
+// completed at least one build, successful or not.
+func runAssetsProcess(ctx context.Context, dir string, out *assetsOutput, cfg AssetsConfig) (bool, error) {
+	cmd := shellCommand(ctx, dir, cfg.Command, cfg.Env)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("[shadowfax] Starting asset bundler: %s\n", cfg.Command)
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("starting asset bundler: %w", err)
+	}
+	if cfg.AddProcess != nil {
+		cfg.AddProcess(cmd)
+	}
+
+	out.started.Store(false)
+	var wg sync.WaitGroup
+	wg.Go(func() { out.scan(stdout, cfg.Verbose) })
+	wg.Go(func() { out.scan(stderr, cfg.Verbose) })
+
+	// Wait closes the pipes, also when a child of the shell still holds
+	// them, which ends the scanners.
+	err = cmd.Wait()
+	wg.Wait()
+	return out.started.Load(), err
+}
+
+// assetsOutput classifies the output lines of a watch-mode bundler. Error
+// lines are reported to onError as they arrive, and the next success line
+// clears them.
+type assetsOutput struct {
+	done, errs *regexp.Regexp
+	built      chan<- AssetsBuild
+	onError    func(msg string)
+
+	// started is set by the first done or error line of a process.
+	started atomic.Bool
+
+	mu     sync.Mutex
+	failed []string
+}
+
+func (o *assetsOutput) scan(reader io.Reader, verbose bool) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if verbose {
+			fmt.Printf("[assets] %s\n", line)
+		}
+		switch {
+		case o.errs.MatchString(line):
+			o.started.Store(true)
+			fmt.Printf("[shadowfax] Asset build failed: %s\n", line)
+			o.fail(line)
+		case o.done.MatchString(line):
+			o.started.Store(true)
+			o.succeed()
+		}
+	}
+}
+
+func (o *assetsOutput) fail(line string) {
+	o.mu.Lock()
+	if !slices.Contains(o.failed, line) {
+		o.failed = append(o.failed, line)
+		if len(o.failed) > maxAssetsErrorLines {
+			o.failed = o.failed[len(o.failed)-maxAssetsErrorLines:]
+		}
+	}
+	msg := strings.Join(o.failed, "\n")
+	o.mu.Unlock()
+	if o.onError != nil {
+		o.onError(msg)
+	}
+}
+
+func (o *assetsOutput) succeed() {
+	o.mu.Lock()
+	hadErrors := len(o.failed) > 0
+	o.failed = nil
+	o.mu.Unlock()
+	if hadErrors && o.onError != nil {
+		o.onError("")
+	}
+	select {
+	case o.built <- AssetsBuild{}:
+	default:
+	}
+}
+
+func runAssetsOnChange(ctx context.Context, dir string, built chan<- AssetsBuild, cfg AssetsConfig) error {
+	w, err := newNotifyBackend(DefaultPollInterval)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	sources := cfg.Sources
+	if len(sources) == 0 {
+		sources = []string{config.DefaultAssetsSource}
+	}
+	for _, src := range sources {
+		if err := addWatchTree(w, filepath.Join(dir, src)); err != nil {
+			fmt.Printf("[shadowfax] Could not watch asset source %s: %v\n", src, err)
+		}
+	}
+	fmt.Printf("[shadowfax] Building assets on changes in %s\n", strings.Join(sources, ", "))
+
+	if buildAssets(ctx, dir, cfg) != nil && ctx.Err() != nil {
+		return nil
+	}
+
+	var pending []string
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.Events():
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+					if err := addWatchTree(w, event.Name); err != nil && cfg.Verbose {
+						fmt.Printf("[shadowfax] failed to watch directory %s: %v\n", event.Name, err)
+					}
+					continue
+				}
+			}
+			rel, err := filepath.Rel(dir, event.Name)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if strings.HasPrefix(filepath.Base(rel), ".") || matchAny(cfg.Exclude, rel) {
+				continue
+			}
+			if !slices.Contains(pending, rel) {
+				pending = append(pending, rel)
+			}
+			fire = time.After(assetsDebounce)
+		case err, ok := <-w.Errors():
+			if ok && cfg.Verbose {
+				fmt.Printf("[shadowfax] asset watcher error: %v\n", err)
+			}
+		case <-fire:
+			fire = nil
+			files := pending
+			pending = nil
+			if cfg.Verbose {
+				fmt.Printf("[shadowfax] Asset sources changed: %s\n", strings.Join(files, ", "))
+			}
+			if err := buildAssets(ctx, dir, cfg); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				continue
+			}
+			select {
+			case built <- AssetsBuild{Files: files}:
+			default:
+			}
+		}
+	}
+}
+
+// buildAssets runs one build and reports its result to OnError.
+func buildAssets(ctx context.Context, dir string, cfg AssetsConfig) error {
+	start := time.Now()
+	out, err := shellCommand(ctx, dir, cfg.Command, cfg.Env).CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if cfg.Verbose {
+		for line := range strings.Lines(string(out)) {
+			fmt.Printf("[assets] %s", line)
+		}
+	}
+	if err != nil {
+		msg := strings.TrimSpace(string(bytes.TrimSpace(out)) + "\n" + err.Error())
+		fmt.Printf("[shadowfax] Asset build failed: %s\n", msg)
+		if cfg.OnError != nil {
+			cfg.OnError(msg)
+		}
+		return err
+	}
+	fmt.Printf("[shadowfax] Assets built in %s\n", time.Since(start).Round(time.Millisecond))
+	if cfg.OnError != nil {
+		cfg.OnError("")
+	}
+	return nil
+}
+
+// addWatchTree watches root and its subdirectories, skipping dot
+// directories, node_modules and tmp.
+func addWatchTree(w backend, root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != root && (strings.HasPrefix(d.Name(), ".") || d.Name() == "node_modules" || d.Name() == "tmp") {
+			return filepath.SkipDir
+		}
+		return w.Add(p)
+	})
+}
@@ -0,0 +1,193 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	tmp := t.TempDir()
+	oldWD, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(oldWD) })
+	return tmp
+}
+
+func TestRunAssetsWatcherBuildsOnChange(t *testing.T) {
+	tmp := chdirTemp(t)
+	if err := os.MkdirAll(filepath.Join(tmp, "assets", "js"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	built := make(chan AssetsBuild, 1)
+	errs := make(chan string, 4)
+	go RunAssetsWatcher(ctx, built, AssetsConfig{
+		Command: "cat assets/js/*.js > bundle.js 2>/dev/null || true",
+		OnError: func(msg string) { errs <- msg },
+	})
+
+	// The startup build reports a clean result.
+	select {
+	case msg := <-errs:
+		if msg != "" {
+			t.Fatalf("unexpected startup error: %s", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a startup build")
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, "assets", "js", "app.js"), []byte("console.log(1)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-built:
+		if !slices.Contains(b.Files, "assets/js/app.js") {
+			t.Fatalf("expected changed source in build, got %v", b.Files)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected a build after the source changed")
+	}
+	if data, err := os.ReadFile(filepath.Join(tmp, "bundle.js")); err != nil || string(data) != "console.log(1)\n" {
+		t.Fatalf("unexpected bundle: %q, %v", data, err)
+	}
+}
+
+func TestBuildAssetsReportsFailure(t *testing.T) {
+	dir := t.TempDir()
+	var got string
+	err := buildAssets(context.Background(), dir, AssetsConfig{
+		Command: "echo 'app.js:1: unexpected token'; exit 1",
+		OnError: func(msg string) { got = msg },
+	})
+	if err == nil {
+		t.Fatal("expected build error")
+	}
+	if got != "app.js:1: unexpected token\nexit status 1" {
+		t.Fatalf("unexpected error message: %q", got)
+	}
+}
+
+func TestRunAssetsWatcherWatchModeSignalsDone(t *testing.T) {
+	chdirTemp(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	built := make(chan AssetsBuild, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- RunAssetsWatcher(ctx, built, AssetsConfig{
+			Command: "echo '[watch] build finished'; sleep 5",
+			Watch:   true,
+		})
+	}()
+
+	select {
+	case <-built:
+	case err := <-errCh:
+		t.Fatalf("bundler exited early: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a build from the completion line")
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("expected nil on cancel, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunAssetsWatcher did not return after cancel")
+	}
+}
+
+func TestDefaultAssetsPatterns(t *testing.T) {
+	tests := []struct {
+		line        string
+		done, error bool
+	}{
+		{line: "[watch] build finished", done: true},
+		{line: "✓ built in 1.23s", done: true},
+		{line: "webpack 5.88.0 compiled successfully in 812 ms", done: true},
+		{line: "webpack 5.88.0 compiled with 1 warning in 812 ms", done: true},
+		{line: "webpack 5.88.0 compiled with 2 errors in 812 ms", error: true},
+		{line: "webpack 5.88.0 compiled with 1 error and 1 warning in 812 ms", error: true},
+		{line: "ERROR in ./src/app.js 3:4", error: true},
+		{line: "✘ [ERROR] Expected \";\" but found \"}\"", error: true},
+		{line: "error during build:", error: true},
+		{line: "[!] RollupError: Unexpected token", error: true},
+		{line: "created dist/bundle.js in 1.2s", done: true},
+		{line: "Bundled 3 modules in 12ms", done: true},
+		{line: "watching for changes..."},
+	}
+	for _, tt := range tests {
+		if got := defaultAssetsDone.MatchString(tt.line) && !defaultAssetsError.MatchString(tt.line); got != tt.done {
+			t.Errorf("done(%q) = %v, want %v", tt.line, got, tt.done)
+		}
+		if got := defaultAssetsError.MatchString(tt.line); got != tt.error {
+			t.Errorf("error(%q) = %v, want %v", tt.line, got, tt.error)
+		}
+	}
+}
+
+func TestRunAssetsWatcherWatchModeReportsErrorsAndRestarts(t *testing.T) {
+	chdirTemp(t)
+	oldBackoff := assetsRestartBackoff
+	assetsRestartBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { assetsRestartBackoff = oldBackoff })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	built := make(chan AssetsBuild, 1)
+	errs := make(chan string, 8)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- RunAssetsWatcher(ctx, built, AssetsConfig{
+			Command: "echo '✘ [ERROR] Unexpected \"}\"'; sleep 0.2; echo '[watch] build finished'; sleep 0.2; exit 1",
+			Watch:   true,
+			OnError: func(msg string) { errs <- msg },
+		})
+	}()
+
+	expectMsg := func(want string) {
+		t.Helper()
+		select {
+		case got := <-errs:
+			if got != want {
+				t.Fatalf("expected error %q, got %q", want, got)
+			}
+		case err := <-errCh:
+			t.Fatalf("bundler watcher returned: %v", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for error %q", want)
+		}
+	}
+	expectMsg(`✘ [ERROR] Unexpected "}"`)
+	expectMsg("")
+	<-built
+
+	// The exit shows as an error and the bundler is restarted.
+	expectMsg("asset bundler exited (exit status 1)")
+	expectMsg("asset bundler exited (exit status 1)\n" + `✘ [ERROR] Unexpected "}"`)
+	expectMsg("")
+	select {
+	case <-built:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected a build from the restarted bundler")
+	}
+}
@@ -0,0 +1,229 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Go watcher backends.
+const (
+	// BackendAuto uses fsnotify unless a startup probe shows that events
+	// aren't delivered, then falls back to polling.
+	BackendAuto     = "auto"
+	BackendFsnotify = "fsnotify"
+	BackendPoll     = "poll"
+)
+
+// DefaultPollInterval is how often the polling backend rescans.
+const DefaultPollInterval = 500 * time.Millisecond
+
+const (
+	probeFile    = ".shadowfax-probe"
+	probeTimeout = time.Second
+)
+
+// backend is a non-recursive directory watcher: Add registers a single
+// directory and events are reported for its direct entries.
+type backend interface {
+	Add(path string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// notifyBackend uses fsnotify. Once the inotify watch limit is exhausted,
+// the remaining directories are polled instead.
+type notifyBackend struct {
+	w        *fsnotify.Watcher
+	add      func(string) error
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+
+	mu      sync.Mutex
+	watched int
+	poll    *pollBackend
+}
+
+func newNotifyBackend(interval time.Duration) (*notifyBackend, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	n := &notifyBackend{
+		w:        w,
+		add:      w.Add,
+		interval: interval,
+		events:   make(chan fsnotify.Event, 64),
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go n.forward(w.Events, w.Errors)
+	return n, nil
+}
+
+func (n *notifyBackend) Add(path string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.poll != nil {
+		return n.poll.Add(path)
+	}
+	err := n.add(path)
+	if errors.Is(err, syscall.ENOSPC) {
+		fmt.Print(watchLimitMessage(n.watched, readWatchLimit(), n.interval))
+		n.poll = newPollBackend(n.interval)
+		go n.forward(n.poll.Events(), n.poll.Errors())
+		return n.poll.Add(path)
+	}
+	if err == nil {
+		n.watched++
+	}
+	return err
+}
+
+func (n *notifyBackend) Events() <-chan fsnotify.Event { return n.events }
+func (n *notifyBackend) Errors() <-chan error          { return n.errors }
+
+func (n *notifyBackend) Close() error {
+	n.once.Do(func() { close(n.done) })
+	n.mu.Lock()
+	if n.poll != nil {
+		n.poll.Close()
+	}
+	n.mu.Unlock()
+	if n.w == nil {
+		return nil
+	}
+	return n.w.Close()
+}
+
+func (n *notifyBackend) forward(events <-chan fsnotify.Event, errs <-chan error) {
+	for {
+		select {
+		case <-n.done:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			select {
+			case n.events <- event:
+			case <-n.done:
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			select {
+			case n.errors <- err:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
+
+const watchLimitFile = "/proc/sys/fs/inotify/max_user_watches"
+
+func readWatchLimit() string {
+	data, err := os.ReadFile(watchLimitFile)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func watchLimitMessage(watched int, limit string, interval time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[shadowfax] inotify watch limit reached after %d directories (fs.inotify.max_user_watches = %s)\n", watched, limit)
+	fmt.Fprintf(&b, "[shadowfax] Polling the remaining directories every %s. To raise the limit:\n", interval)
+	b.WriteString("[shadowfax]   sudo sysctl fs.inotify.max_user_watches=524288\n")
+	return b.String()
+}
+
+// openBackend creates the configured backend and registers every watched
+// directory under root.
+func openBackend(root string, cfg GoWatcherConfig, filter *pathFilter, embeds *embedIndex) (backend, error) {
+	interval := cfg.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	switch cfg.Backend {
+	case BackendPoll:
+		return openPollBackend(root, interval, filter, embeds)
+	case "", BackendAuto, BackendFsnotify:
+	default:
+		return nil, fmt.Errorf("unknown watcher backend %q", cfg.Backend)
+	}
+
+	n, err := newNotifyBackend(interval)
+	if err != nil {
+		if cfg.Backend == BackendFsnotify {
+			return nil, err
+		}
+		fmt.Printf("[shadowfax] fsnotify unavailable (%v), falling back to polling\n", err)
+		return openPollBackend(root, interval, filter, embeds)
+	}
+	if err := addWatchRecursive(n, root, filter, embeds); err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	if cfg.Backend == BackendFsnotify || probeEvents(n, root, probeTimeout) {
+		return n, nil
+	}
+
+	n.Close()
+	fmt.Println("[shadowfax] File events aren't arriving (network or bind mount?), falling back to polling")
+	return openPollBackend(root, interval, filter, embeds)
+}
+
+func openPollBackend(root string, interval time.Duration, filter *pathFilter, embeds *embedIndex) (backend, error) {
+	p := newPollBackend(interval)
+	if err := addWatchRecursive(p, root, filter, embeds); err != nil {
+		p.Close()
+		return nil, err
+	}
+	fmt.Printf("[shadowfax] Polling for Go changes every %s\n", interval)
+	return p, nil
+}
+
+// probeEvents writes a file into dir and reports whether b delivers an event
+// for it within timeout. If the probe can't be written the backend is
+// assumed to work.
+func probeEvents(b backend, dir string, timeout time.Duration) bool {
+	path := filepath.Join(dir, probeFile)
+	if err := os.WriteFile(path, []byte("shadowfax\n"), 0o644); err != nil {
+		return true
+	}
+	defer os.Remove(path)
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-b.Events():
+			if !ok {
+				return false
+			}
+			if event.Name == path {
+				return true
+			}
+		case <-b.Errors():
+		case <-deadline:
+			return false
+		}
+	}
+}
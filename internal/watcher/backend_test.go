@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestNotifyBackendPollsDirectoriesPastWatchLimit(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+
+	n := &notifyBackend{
+		interval: 10 * time.Millisecond,
+		events:   make(chan fsnotify.Event, 64),
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	n.add = func(string) error {
+		if n.watched == 2 {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	defer n.Close()
+
+	for _, dir := range dirs {
+		if err := n.Add(dir); err != nil {
+			t.Fatalf("Add(%s) returned error: %v", dir, err)
+		}
+	}
+	if n.watched != 2 || n.poll == nil {
+		t.Fatalf("expected 2 inotify watches and a polling fallback, got %d watches", n.watched)
+	}
+
+	path := filepath.Join(dirs[2], "main.go")
+	writeFile(t, path, "package main\n")
+	expectEvent(t, n, path, fsnotify.Create)
+}
+
+func TestWatchLimitMessage(t *testing.T) {
+	msg := watchLimitMessage(8190, "8192", 500*time.Millisecond)
+	for _, want := range []string{
+		"after 8190 directories",
+		"max_user_watches = 8192",
+		"every 500ms",
+		"sudo sysctl fs.inotify.max_user_watches=",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("expected %q in message:\n%s", want, msg)
+		}
+	}
+}
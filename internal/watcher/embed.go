@@ -0,0 +1,109 @@
+package watcher
+
+import (
+	"go/build"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// moduleFiles are non-Go build inputs that always trigger a rebuild.
+var moduleFiles = map[string]bool{
+	"go.mod": true, "go.sum": true, "go.work": true, "go.work.sum": true,
+}
+
+func isModuleFile(path string) bool {
+	return moduleFiles[filepath.Base(path)]
+}
+
+// embedIndex tracks the //go:embed patterns of every watched package so
+// that changes to embedded files trigger a rebuild.
+type embedIndex struct {
+	mu    sync.RWMutex
+	byDir map[string][]string
+}
+
+func newEmbedIndex() *embedIndex {
+	return &embedIndex{byDir: make(map[string][]string)}
+}
+
+// scan (re)reads the embed directives of the package in dir.
+func (e *embedIndex) scan(dir string) {
+	// ImportDir returns a partially filled package on most errors, which is
+	// enough to read the directives.
+	pkg, _ := build.Default.ImportDir(dir, 0)
+	var patterns []string
+	if pkg != nil {
+		for _, p := range append(append([]string{}, pkg.EmbedPatterns...), pkg.TestEmbedPatterns...) {
+			patterns = append(patterns, filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(p, "all:"))))
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(patterns) == 0 {
+		delete(e.byDir, dir)
+		return
+	}
+	e.byDir[dir] = patterns
+}
+
+// matches reports whether path is embedded by a package, either directly
+// through a file pattern or by living inside an embedded directory.
+func (e *embedIndex) matches(path string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for dir, patterns := range e.byDir {
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			continue
+		}
+		for candidate := path; candidate != dir; candidate = filepath.Dir(candidate) {
+			for _, pattern := range patterns {
+				if ok, _ := filepath.Match(pattern, candidate); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// covers reports whether files embedded by some package can live in dir:
+// dir is embedded itself, or lies on the way to a pattern. Such directories
+// are watched even when the filter would skip them.
+func (e *embedIndex) covers(dir string) bool {
+	if e.matches(dir) {
+		return true
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for pkgDir, patterns := range e.byDir {
+		rel, err := filepath.Rel(pkgDir, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		dirParts := strings.Split(rel, string(filepath.Separator))
+		for _, pattern := range patterns {
+			patternParts := strings.Split(strings.TrimPrefix(pattern, pkgDir+string(filepath.Separator)), string(filepath.Separator))
+			if len(dirParts) >= len(patternParts) {
+				continue
+			}
+			if matchParts(patternParts, dirParts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchParts(patterns, parts []string) bool {
+	for i, part := range parts {
+		if ok, _ := filepath.Match(patterns[i], part); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package watcher
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+)
+
+func TestEmbedIndexMatchesEmbeddedFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "queries.go"), `package db
+
+import "embed"
+
+//go:embed queries/*.sql
+var queries embed.FS
+
+//go:embed emails
+var emails embed.FS
+
+//go:embed config.json
+var config []byte
+`)
+	writeFile(t, filepath.Join(root, "queries", "users.sql"), "select 1;")
+	writeFile(t, filepath.Join(root, "emails", "welcome", "body.html"), "<p>hi</p>")
+	writeFile(t, filepath.Join(root, "config.json"), "{}")
+
+	e := newEmbedIndex()
+	e.scan(root)
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "queries/users.sql", want: true},
+		{path: "queries/new.sql", want: true},
+		{path: "queries/notes.txt", want: false},
+		{path: "emails/welcome/body.html", want: true},
+		{path: "config.json", want: true},
+		{path: "other.json", want: false},
+	}
+	for _, tt := range tests {
+		if got := e.matches(filepath.Join(root, tt.path)); got != tt.want {
+			t.Errorf("matches(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestEmbedIndexRescanDropsRemovedDirectives(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "static.go")
+	writeFile(t, src, "package static\n\nimport _ \"embed\"\n\n//go:embed robots.txt\nvar robots string\n")
+
+	e := newEmbedIndex()
+	e.scan(root)
+	if !e.matches(filepath.Join(root, "robots.txt")) {
+		t.Fatal("expected robots.txt to be embedded")
+	}
+
+	writeFile(t, src, "package static\n")
+	e.scan(root)
+	if e.matches(filepath.Join(root, "robots.txt")) {
+		t.Fatal("expected robots.txt to be dropped after the directive is removed")
+	}
+}
+
+func TestIsBuildInput(t *testing.T) {
+	root := t.TempDir()
+	f := newPathFilter(root, FilterConfig{})
+	e := newEmbedIndex()
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "main.go", want: true},
+		{path: "views/home_templ.go", want: false},
+		{path: "go.mod", want: true},
+		{path: "go.sum", want: true},
+		{path: "go.work", want: true},
+		{path: "README.md", want: false},
+	}
+	for _, tt := range tests {
+		if got := isBuildInput(filepath.Join(root, tt.path), f, e); got != tt.want {
+			t.Errorf("isBuildInput(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGoWatcherRebuildsOnEmbeddedAssetChange(t *testing.T) {
+	root := t.TempDir()
+	t.Chdir(root)
+	writeFile(t, filepath.Join(root, "static.go"), `package static
+
+import "embed"
+
+//go:embed assets/css/*.css
+var css embed.FS
+`)
+	asset := filepath.Join(root, "assets", "css", "app.css")
+	writeFile(t, asset, "body {}")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rebuildChan := make(chan changes.Set, 1)
+	go RunGoWatcher(ctx, rebuildChan, GoWatcherConfig{Backend: BackendPoll, PollInterval: 10 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond)
+
+	writeFile(t, asset, "body { color: red }")
+	select {
+	case set := <-rebuildChan:
+		if len(set.Files) != 1 || set.Files[0].Path != asset {
+			t.Fatalf("expected a rebuild for %s, got %+v", asset, set.Files)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected a change to an embedded file under assets/ to trigger a rebuild")
+	}
+}
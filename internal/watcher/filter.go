@@ -0,0 +1,207 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// FilterConfig controls which paths the Go watcher registers and reacts to.
+// Patterns use doublestar syntax and are matched against slash-separated
+// paths relative to the project root.
+type FilterConfig struct {
+	// Include patterns always win, even over dot-directories, the built-in
+	// excludes and ignore files.
+	Include []string
+	// Exclude patterns are skipped in addition to the built-in excludes.
+	Exclude []string
+	// Gitignore honors .gitignore files, including nested ones.
+	Gitignore bool
+}
+
+const gitignoreFile = ".gitignore"
+
+// pathFilter decides which directories and files under root are watched.
+type pathFilter struct {
+	root string
+	cfg  FilterConfig
+
+	mu      sync.Mutex
+	ignores map[string][]ignoreRule
+}
+
+func newPathFilter(root string, cfg FilterConfig) *pathFilter {
+	return &pathFilter{
+		root:    root,
+		cfg:     cfg,
+		ignores: make(map[string][]ignoreRule),
+	}
+}
+
+// skipDir reports whether the directory at p (and everything below it)
+// should not be watched.
+func (f *pathFilter) skipDir(p string) bool {
+	rel, ok := f.rel(p)
+	if !ok {
+		return true
+	}
+	if rel == "." {
+		return false
+	}
+	if f.included(rel) {
+		return false
+	}
+	if shouldSkipDir(path.Base(rel)) || matchAny(f.cfg.Exclude, rel) {
+		return true
+	}
+	return f.cfg.Gitignore && f.gitignored(rel, true)
+}
+
+// skipFile reports whether a change to the file at p should be ignored.
+func (f *pathFilter) skipFile(p string) bool {
+	rel, ok := f.rel(p)
+	if !ok {
+		return true
+	}
+	if f.included(rel) {
+		return false
+	}
+	if matchAny(f.cfg.Exclude, rel) {
+		return true
+	}
+	return f.cfg.Gitignore && f.gitignored(rel, false)
+}
+
+// forget drops cached ignore rules when an ignore file changes.
+func (f *pathFilter) forget(p string) {
+	if filepath.Base(p) != gitignoreFile {
+		return
+	}
+	rel, ok := f.rel(filepath.Dir(p))
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	delete(f.ignores, rel)
+	f.mu.Unlock()
+}
+
+func (f *pathFilter) rel(p string) (string, bool) {
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (f *pathFilter) included(rel string) bool {
+	return matchAny(f.cfg.Include, rel)
+}
+
+// gitignored applies the .gitignore files from the root down to the parent
+// of rel. As in git, the last matching rule wins.
+func (f *pathFilter) gitignored(rel string, isDir bool) bool {
+	ignored := false
+	dir := "."
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if i > 0 {
+			dir = path.Join(dir, parts[i-1])
+		}
+		sub := strings.Join(parts[i:], "/")
+		for _, rule := range f.rulesFor(dir) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if ok, _ := doublestar.Match(rule.pattern, sub); ok {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (f *pathFilter) rulesFor(dir string) []ignoreRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rules, ok := f.ignores[dir]; ok {
+		return rules
+	}
+	rules := loadIgnoreFile(filepath.Join(f.root, filepath.FromSlash(dir), gitignoreFile))
+	f.ignores[dir] = rules
+	return rules
+}
+
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+func loadIgnoreFile(p string) []ignoreRule {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// parseIgnoreLine converts one .gitignore line into a doublestar pattern
+// relative to the directory holding the file.
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// A slash anywhere but the end anchors the pattern to this directory;
+	// otherwise it matches at any depth.
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	if !doublestar.ValidatePattern(line) {
+		return ignoreRule{}, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ignoreRule
+		ok   bool
+	}{
+		{line: "# comment", ok: false},
+		{line: "   ", ok: false},
+		{line: "node_modules/", want: ignoreRule{pattern: "**/node_modules", dirOnly: true}, ok: true},
+		{line: "/generated", want: ignoreRule{pattern: "generated"}, ok: true},
+		{line: "internal/fixtures/**", want: ignoreRule{pattern: "internal/fixtures/**"}, ok: true},
+		{line: "!keep.go", want: ignoreRule{pattern: "**/keep.go", negate: true}, ok: true},
+		{line: `\#literal`, want: ignoreRule{pattern: "**/#literal"}, ok: true},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseIgnoreLine(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Fatalf("parseIgnoreLine(%q) = %+v, %v; want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPathFilterSkipDir(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".gitignore"), "/generated\nfixtures/\n")
+	writeFile(t, filepath.Join(root, "internal", ".gitignore"), "scratch\n!fixtures\n")
+
+	f := newPathFilter(root, FilterConfig{
+		Include:   []string{"internal/.config/**"},
+		Exclude:   []string{"**/big_testdata"},
+		Gitignore: true,
+	})
+
+	tests := []struct {
+		dir  string
+		skip bool
+	}{
+		{dir: ".", skip: false},
+		{dir: "internal", skip: false},
+		{dir: "tmp", skip: true},
+		{dir: ".cache", skip: true},
+		{dir: "internal/.config", skip: false},
+		{dir: "generated", skip: true},
+		{dir: "pkg/generated", skip: false},
+		{dir: "pkg/fixtures", skip: true},
+		{dir: "internal/fixtures", skip: false},
+		{dir: "internal/scratch", skip: true},
+		{dir: "pkg/big_testdata", skip: true},
+	}
+
+	for _, tt := range tests {
+		if got := f.skipDir(filepath.Join(root, tt.dir)); got != tt.skip {
+			t.Errorf("skipDir(%q) = %v, want %v", tt.dir, got, tt.skip)
+		}
+	}
+}
+
+func TestPathFilterGitignoreDisabled(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".gitignore"), "generated/\n")
+
+	f := newPathFilter(root, FilterConfig{})
+	if f.skipDir(filepath.Join(root, "generated")) {
+		t.Fatal("expected .gitignore to be ignored when disabled")
+	}
+}
+
+func TestPathFilterSkipFile(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".gitignore"), "*_gen.go\n")
+
+	f := newPathFilter(root, FilterConfig{Gitignore: true, Exclude: []string{"**/*_mock.go"}})
+
+	if !f.skipFile(filepath.Join(root, "models", "user_gen.go")) {
+		t.Fatal("expected gitignored file to be skipped")
+	}
+	if !f.skipFile(filepath.Join(root, "models", "user_mock.go")) {
+		t.Fatal("expected excluded file to be skipped")
+	}
+	if f.skipFile(filepath.Join(root, "models", "user.go")) {
+		t.Fatal("expected regular file to be watched")
+	}
+}
+
+func TestPathFilterForgetReloadsIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	ignorePath := filepath.Join(root, ".gitignore")
+	writeFile(t, ignorePath, "")
+
+	f := newPathFilter(root, FilterConfig{Gitignore: true})
+	if f.skipDir(filepath.Join(root, "generated")) {
+		t.Fatal("expected directory to be watched before it is ignored")
+	}
+
+	writeFile(t, ignorePath, "generated/\n")
+	f.forget(ignorePath)
+
+	if !f.skipDir(filepath.Join(root, "generated")) {
+		t.Fatal("expected updated .gitignore to be applied")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
 )
 
 var excludeDirs = map[string]bool{
@@ -16,65 +19,95 @@ var excludeDirs = map[string]bool{
 	".git": true, "assets": true, "vendor": true,
 }
 
-func RunGoWatcher(ctx context.Context, rebuildChan chan<- struct{}, verbose bool) error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
-	defer watcher.Close()
+type GoWatcherConfig struct {
+	Verbose bool
+	Filter  FilterConfig
+	// Backend is BackendAuto (the default), BackendFsnotify or BackendPoll.
+	Backend string
+	// PollInterval is the rescan interval of the polling backend.
+	PollInterval time.Duration
+}
+
+// RunGoWatcher sends the files changed within each debounce window to
+// rebuildChan, merging with a set that hasn't been picked up yet.
+func RunGoWatcher(ctx context.Context, rebuildChan chan changes.Set, cfg GoWatcherConfig) error {
+	verbose := cfg.Verbose
 
 	wd, _ := os.Getwd()
+	filter := newPathFilter(wd, cfg.Filter)
+	embeds := newEmbedIndex()
 
-	// Recursively add directories.
-	if err := addWatchRecursive(watcher, wd); err != nil {
+	// Open the backend and recursively add directories.
+	watcher, err := openBackend(wd, cfg, filter, embeds)
+	if err != nil {
 		return err
 	}
+	defer watcher.Close()
 
 	// Debounce timer
 	var debounceTimer *time.Timer
 	debounceDelay := 500 * time.Millisecond
+	var pendingMu sync.Mutex
+	var pending changes.Set
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case event, ok := <-watcher.Events:
+		case event, ok := <-watcher.Events():
 			if !ok {
 				return nil
 			}
 
+			filter.forget(event.Name)
+
 			// Add new directories to the watcher as they are created.
 			if event.Op&fsnotify.Create != 0 {
 				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
-					if shouldSkipDir(filepath.Base(event.Name)) {
+					if filter.skipDir(event.Name) && !embeds.covers(event.Name) {
 						continue
 					}
-					if err := addWatchRecursive(watcher, event.Name); err != nil && verbose {
+					if err := addWatchRecursive(watcher, event.Name, filter, embeds); err != nil && verbose {
 						fmt.Printf("[shadowfax] failed to watch directory %s: %v\n", event.Name, err)
 					}
 					continue
 				}
 			}
 
-			if !isGoFile(event.Name) || isTemplGenerated(event.Name) {
+			if !isBuildInput(event.Name, filter, embeds) {
 				continue
 			}
 			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename|fsnotify.Chmod) == 0 {
 				continue
 			}
 
+			// Embed directives may have changed along with the Go code.
+			if isGoFile(event.Name) {
+				embeds.scan(filepath.Dir(event.Name))
+			}
+
 			// Debounce
+			pendingMu.Lock()
+			if pending.Detected.IsZero() {
+				pending.Detected = time.Now()
+			}
+			pending.Add(event.Name, changeOp(event.Op))
+			pendingMu.Unlock()
 			if debounceTimer != nil {
 				debounceTimer.Stop()
 			}
 			debounceTimer = time.AfterFunc(debounceDelay, func() {
-				fmt.Printf("[shadowfax] Go file changed: %s\n", filepath.Base(event.Name))
-				select {
-				case rebuildChan <- struct{}{}:
-				default:
+				pendingMu.Lock()
+				set := pending
+				pending = changes.Set{}
+				pendingMu.Unlock()
+				if len(set.Files) == 0 {
+					return
 				}
+				set.Fired = time.Now()
+				changes.Send(rebuildChan, set)
 			})
-		case err, ok := <-watcher.Errors:
+		case err, ok := <-watcher.Errors():
 			if !ok {
 				return nil
 			}
@@ -85,7 +118,7 @@ func RunGoWatcher(ctx context.Context, rebuildChan chan<- struct{}, verbose bool
 	}
 }
 
-func addWatchRecursive(w *fsnotify.Watcher, root string) error {
+func addWatchRecursive(w backend, root string, filter *pathFilter, embeds *embedIndex) error {
 	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return nil
@@ -94,7 +127,10 @@ func addWatchRecursive(w *fsnotify.Watcher, root string) error {
 			return nil
 		}
 
-		if shouldSkipDir(d.Name()) {
+		// Embedded directories such as assets are build inputs even where
+		// the filter would skip them. The package embedding them is scanned
+		// before WalkDir descends into it.
+		if filter.skipDir(path) && !embeds.covers(path) {
 			return filepath.SkipDir
 		}
 
@@ -102,11 +138,42 @@ func addWatchRecursive(w *fsnotify.Watcher, root string) error {
 		if err := w.Add(path); err != nil && !os.IsNotExist(err) {
 			return err
 		}
+		embeds.scan(path)
 
 		return nil
 	})
 }
 
+// isBuildInput reports whether a change to path can affect the app binary:
+// Go sources (except templ output), module files and //go:embed'd files.
+// Embedded files count even where the filter would skip them.
+func isBuildInput(path string, filter *pathFilter, embeds *embedIndex) bool {
+	switch {
+	case isGoFile(path):
+		return !isTemplGenerated(path) && !filter.skipFile(path)
+	case isModuleFile(path):
+		return true
+	default:
+		return embeds.matches(path)
+	}
+}
+
+// changeOp maps an fsnotify event to the most significant operation.
+func changeOp(op fsnotify.Op) changes.Op {
+	switch {
+	case op&fsnotify.Remove != 0:
+		return changes.OpRemove
+	case op&fsnotify.Rename != 0:
+		return changes.OpRename
+	case op&fsnotify.Create != 0:
+		return changes.OpCreate
+	case op&fsnotify.Write != 0:
+		return changes.OpWrite
+	default:
+		return changes.OpChmod
+	}
+}
+
 func shouldSkipDir(name string) bool {
 	return excludeDirs[name] || strings.HasPrefix(name, ".")
 }
@@ -0,0 +1,173 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+)
+
+const SourceMigrations = "migrations"
+
+var migrationsDebounce = 200 * time.Millisecond
+
+// MigrationsWatcher watches the migrations directory and restarts the app
+// when migrations are added or changed. BeforeStart, wired into the app
+// server, applies them first.
+type MigrationsWatcher struct {
+	Verbose bool
+	// OnError receives the output of a failed migration, or "" once the
+	// migrations apply again.
+	OnError func(msg string)
+	// Env holds KEY=VALUE overrides for the migration commands.
+	Env []string
+	// Dir, Command and Status mirror config.MigrationsConfig.
+	Dir     string
+	Command string
+	Status  string
+
+	mu      sync.Mutex
+	pending bool
+}
+
+func (*MigrationsWatcher) Name() string { return SourceMigrations }
+
+func (m *MigrationsWatcher) Run(ctx context.Context, events chan<- dispatch.Event) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	m.printStatus(ctx)
+
+	w, err := newNotifyBackend(DefaultPollInterval)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := addWatchTree(w, filepath.Join(wd, m.Dir)); err != nil {
+		fmt.Printf("[shadowfax] Could not watch migrations in %s: %v\n", m.Dir, err)
+	}
+
+	pending := changes.Set{}
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.Events():
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+					if err := addWatchTree(w, event.Name); err != nil && m.Verbose {
+						fmt.Printf("[shadowfax] failed to watch directory %s: %v\n", event.Name, err)
+					}
+					continue
+				}
+			}
+			// Skip editor swap and backup files.
+			base := filepath.Base(event.Name)
+			if strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") {
+				continue
+			}
+			rel, err := filepath.Rel(wd, event.Name)
+			if err != nil {
+				continue
+			}
+			if pending.Detected.IsZero() {
+				pending.Detected = time.Now()
+			}
+			pending.Add(filepath.ToSlash(rel), changeOp(event.Op))
+			fire = time.After(migrationsDebounce)
+		case err, ok := <-w.Errors():
+			if ok && m.Verbose {
+				fmt.Printf("[shadowfax] migrations watcher error: %v\n", err)
+			}
+		case <-fire:
+			fire = nil
+			set := pending
+			set.Fired = time.Now()
+			set.Reason = "migrations changed"
+			pending = changes.Set{}
+
+			m.mu.Lock()
+			m.pending = true
+			m.mu.Unlock()
+			fmt.Printf("[shadowfax] Migrations changed: %s\n", strings.Join(set.Paths(), ", "))
+			dispatch.Emit(ctx, events, dispatch.Event{Source: SourceMigrations, Action: dispatch.ActionRestartApp, Changes: set})
+		}
+	}
+}
+
+// BeforeStart applies changed migrations before the app starts. A failed
+// migration keeps the app from starting until the next attempt succeeds.
+func (m *MigrationsWatcher) BeforeStart(ctx context.Context) error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = false
+	m.mu.Unlock()
+	if !pending {
+		return nil
+	}
+
+	fmt.Printf("[shadowfax] Running migrations: %s\n", m.Command)
+	out, err := m.run(ctx, m.Command)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		m.mu.Lock()
+		m.pending = true
+		m.mu.Unlock()
+		msg := strings.TrimSpace(out + "\n" + err.Error())
+		if m.OnError != nil {
+			m.OnError(msg)
+		}
+		return fmt.Errorf("migrations failed: %w", err)
+	}
+	fmt.Println("[shadowfax] Migrations applied")
+	if m.OnError != nil {
+		m.OnError("")
+	}
+	return nil
+}
+
+// printStatus prints the output of the status command, if one is set.
+func (m *MigrationsWatcher) printStatus(ctx context.Context) {
+	if m.Status == "" {
+		return
+	}
+	fmt.Println("[shadowfax] Migration status:")
+	if _, err := m.run(ctx, m.Status); err != nil && ctx.Err() == nil {
+		fmt.Printf("[shadowfax] Migration status failed: %v\n", err)
+	}
+}
+
+// run runs command from the project root, printing its output prefixed
+// with [migrations], and returns the output.
+func (m *MigrationsWatcher) run(ctx context.Context, command string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	out, err := shellCommand(ctx, wd, command, m.Env).CombinedOutput()
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 {
+		for line := range strings.Lines(string(out)) {
+			fmt.Printf("[migrations] %s\n", strings.TrimSuffix(line, "\n"))
+		}
+	}
+	return string(out), err
+}
@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+)
+
+func TestMigrationsWatcherAppliesChangesBeforeStart(t *testing.T) {
+	tmp := chdirTemp(t)
+	dir := filepath.Join(tmp, "database", "migrations")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d time.Duration) { migrationsDebounce = d }(migrationsDebounce)
+	migrationsDebounce = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var errs []string
+	m := &MigrationsWatcher{
+		OnError: func(msg string) { errs = append(errs, msg) },
+		Dir:     "database/migrations",
+		Command: "echo applied >> migrated.log",
+	}
+
+	// Nothing changed yet, so starting runs no migrations.
+	if err := m.BeforeStart(ctx); err != nil {
+		t.Fatalf("BeforeStart returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "migrated.log")); !os.IsNotExist(err) {
+		t.Fatal("expected no migration run without changes")
+	}
+
+	events := make(chan dispatch.Event, 4)
+	go m.Run(ctx, events)
+
+	ev := touchUntilEvent(t, filepath.Join(dir, "00002_add_users.sql"), events)
+	if ev.Source != SourceMigrations || ev.Action != dispatch.ActionRestartApp {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if !slices.Contains(ev.Paths(), "database/migrations/00002_add_users.sql") {
+		t.Fatalf("expected migration in event, got %v", ev.Paths())
+	}
+	cancel()
+
+	if err := m.BeforeStart(context.Background()); err != nil {
+		t.Fatalf("BeforeStart returned error: %v", err)
+	}
+	if err := m.BeforeStart(context.Background()); err != nil {
+		t.Fatalf("BeforeStart returned error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmp, "migrated.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "applied") != 1 {
+		t.Fatalf("expected migrations to run once, got %q", data)
+	}
+	if len(errs) != 1 || errs[0] != "" {
+		t.Fatalf("expected the error to be cleared, got %q", errs)
+	}
+}
+
+func TestMigrationsWatcherBlocksStartUntilFixed(t *testing.T) {
+	tmp := chdirTemp(t)
+
+	var errs []string
+	m := &MigrationsWatcher{
+		OnError: func(msg string) { errs = append(errs, msg) },
+		Command: `test -f fixed || { echo "00003_orders.sql: syntax error"; exit 1; }`,
+		pending: true,
+	}
+
+	if err := m.BeforeStart(context.Background()); err == nil {
+		t.Fatal("expected failed migration to block the start")
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0], "00003_orders.sql: syntax error") {
+		t.Fatalf("expected migration output as error, got %q", errs)
+	}
+
+	// The failed migration is retried on the next start.
+	if err := os.WriteFile(filepath.Join(tmp, "fixed"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.BeforeStart(context.Background()); err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if errs[len(errs)-1] != "" {
+		t.Fatalf("expected the error to be cleared, got %q", errs)
+	}
+}
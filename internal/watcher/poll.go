@@ -0,0 +1,196 @@
+package watcher
+
+import (
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// recentWindow covers coarse mtime resolution on network filesystems: files
+// modified this recently are re-hashed on every scan, since a second write
+// within the same tick can keep both mtime and size.
+const recentWindow = 2 * time.Second
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	isDir   bool
+	hash    uint64
+	hashed  bool
+}
+
+// pollBackend detects changes by rescanning the watched directories,
+// comparing mtime and size and confirming content changes by hash.
+type pollBackend struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+
+	mu   sync.Mutex
+	dirs map[string]map[string]fileState
+}
+
+func newPollBackend(interval time.Duration) *pollBackend {
+	p := &pollBackend{
+		interval: interval,
+		events:   make(chan fsnotify.Event, 64),
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+		dirs:     make(map[string]map[string]fileState),
+	}
+	go p.run()
+	return p
+}
+
+func (p *pollBackend) Events() <-chan fsnotify.Event { return p.events }
+func (p *pollBackend) Errors() <-chan error          { return p.errors }
+
+func (p *pollBackend) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// Add snapshots dir so that only later changes are reported.
+func (p *pollBackend) Add(dir string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.dirs[dir]; ok {
+		return nil
+	}
+	entries, err := readEntries(dir)
+	if err != nil {
+		return err
+	}
+	p.dirs[dir] = entries
+	return nil
+}
+
+func (p *pollBackend) run() {
+	defer close(p.events)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			for _, event := range p.scan() {
+				select {
+				case p.events <- event:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *pollBackend) scan() []fsnotify.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var events []fsnotify.Event
+	for dir, prev := range p.dirs {
+		next, err := readEntries(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The directory is gone; its parent reports the directory
+				// itself.
+				for name := range prev {
+					events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+				}
+				delete(p.dirs, dir)
+				continue
+			}
+			select {
+			case p.errors <- err:
+			default:
+			}
+			continue
+		}
+
+		for name, st := range next {
+			path := filepath.Join(dir, name)
+			old, existed := prev[name]
+			switch {
+			case !existed:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case st.isDir || old.isDir:
+			case contentChanged(path, old, &st):
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+			}
+			next[name] = st
+		}
+		for name := range prev {
+			if _, ok := next[name]; !ok {
+				events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+			}
+		}
+		p.dirs[dir] = next
+	}
+	return events
+}
+
+// contentChanged compares a file against its previous state, filling in the
+// hash of cur when one is computed.
+func contentChanged(path string, old fileState, cur *fileState) bool {
+	if cur.size != old.size {
+		return true
+	}
+	recent := time.Since(cur.modTime) < recentWindow
+	if cur.modTime.Equal(old.modTime) && !recent {
+		cur.hash, cur.hashed = old.hash, old.hashed
+		return false
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return false
+	}
+	cur.hash, cur.hashed = sum, true
+	if !old.hashed {
+		// Without a baseline only a new mtime tells us something changed.
+		return !cur.modTime.Equal(old.modTime)
+	}
+	return sum != old.hash
+}
+
+func readEntries(dir string) (map[string]fileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]fileState, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		states[e.Name()] = fileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			isDir:   info.IsDir(),
+		}
+	}
+	return states, nil
+}
+
+func hashFile(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := fnv.New64a()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
@@ -0,0 +1,110 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func expectEvent(t *testing.T, b backend, name string, op fsnotify.Op) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-b.Events():
+			if event.Name == name && event.Op == op {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s on %s", op, name)
+		}
+	}
+}
+
+func expectNoEvent(t *testing.T, b backend, wait time.Duration) {
+	t.Helper()
+	select {
+	case event := <-b.Events():
+		t.Fatalf("unexpected event %s", event)
+	case <-time.After(wait):
+	}
+}
+
+func TestPollBackendReportsChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	writeFile(t, path, "package main\n")
+
+	p := newPollBackend(10 * time.Millisecond)
+	defer p.Close()
+	if err := p.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, p, 50*time.Millisecond)
+
+	writeFile(t, path, "package main // edited\n")
+	expectEvent(t, p, path, fsnotify.Write)
+
+	added := filepath.Join(dir, "util.go")
+	writeFile(t, added, "package main\n")
+	expectEvent(t, p, added, fsnotify.Create)
+
+	if err := os.Remove(added); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, p, added, fsnotify.Remove)
+}
+
+func TestPollBackendIgnoresTouchWithoutContentChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	writeFile(t, path, "package main\n")
+
+	p := newPollBackend(10 * time.Millisecond)
+	defer p.Close()
+	if err := p.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Let a scan record the content hash of the recently written file.
+	time.Sleep(50 * time.Millisecond)
+
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, p, 100*time.Millisecond)
+}
+
+type silentBackend struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func (s *silentBackend) Add(string) error              { return nil }
+func (s *silentBackend) Events() <-chan fsnotify.Event { return s.events }
+func (s *silentBackend) Errors() <-chan error          { return s.errors }
+func (s *silentBackend) Close() error                  { return nil }
+
+func TestProbeEvents(t *testing.T) {
+	dir := t.TempDir()
+
+	silent := &silentBackend{events: make(chan fsnotify.Event), errors: make(chan error)}
+	if probeEvents(silent, dir, 50*time.Millisecond) {
+		t.Fatal("expected probe to fail when no events arrive")
+	}
+
+	p := newPollBackend(10 * time.Millisecond)
+	defer p.Close()
+	if err := p.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !probeEvents(p, dir, 2*time.Second) {
+		t.Fatal("expected probe to see its own file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, probeFile)); !os.IsNotExist(err) {
+		t.Fatal("expected probe file to be removed")
+	}
+}
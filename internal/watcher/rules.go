@@ -0,0 +1,248 @@
+package watcher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/config"
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+)
+
+const SourceRules = "rules"
+
+// ruleOutputLines is how much command output a failed rule keeps for the
+// error overlay.
+const ruleOutputLines = 50
+
+var ruleDispatchActions = map[string]dispatch.Action{
+	config.RuleActionReload:  dispatch.ActionReloadPage,
+	config.RuleActionCSS:     dispatch.ActionReloadCSS,
+	config.RuleActionRestart: dispatch.ActionRestartApp,
+	config.RuleActionRebuild: dispatch.ActionRebuild,
+}
+
+// RulesWatcher runs the user-defined rules: when files matching a rule
+// change, its command runs and its action is applied. Each rule reports
+// errors as the "rule:<name>" source.
+type RulesWatcher struct {
+	Verbose    bool
+	AddProcess func(*exec.Cmd)
+	// Env holds KEY=VALUE overrides for the rule commands.
+	Env   []string
+	Rules []config.Rule
+}
+
+func (RulesWatcher) Name() string { return SourceRules }
+
+func (w RulesWatcher) Run(ctx context.Context, events chan<- dispatch.Event) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	b, err := newNotifyBackend(DefaultPollInterval)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	for _, root := range ruleRoots(w.Rules) {
+		if err := addWatchTree(b, filepath.Join(wd, root)); err != nil {
+			fmt.Printf("[shadowfax] Could not watch %s for rules: %v\n", root, err)
+		}
+	}
+
+	runners := make([]*ruleRunner, len(w.Rules))
+	for i, rule := range w.Rules {
+		runners[i] = &ruleRunner{rule: rule, watcher: w, dir: wd, in: make(chan changes.File, 64)}
+		go runners[i].loop(ctx, events)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-b.Events():
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+					if err := addWatchTree(b, event.Name); err != nil && w.Verbose {
+						fmt.Printf("[shadowfax] failed to watch directory %s: %v\n", event.Name, err)
+					}
+					continue
+				}
+			}
+			rel, err := filepath.Rel(wd, event.Name)
+			if err != nil {
+				continue
+			}
+			file := changes.File{Path: filepath.ToSlash(rel), Op: changeOp(event.Op)}
+			for _, r := range runners {
+				if matchAny(r.rule.Match, file.Path) {
+					select {
+					case r.in <- file:
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}
+		case err, ok := <-b.Errors():
+			if ok && w.Verbose {
+				fmt.Printf("[shadowfax] rules watcher error: %v\n", err)
+			}
+		}
+	}
+}
+
+// ruleRoots returns the static directories of the rule patterns, leaving
+// out those inside another root.
+func ruleRoots(rules []config.Rule) []string {
+	var roots []string
+	for _, rule := range rules {
+		for _, pattern := range rule.Match {
+			base, _ := doublestar.SplitPattern(pattern)
+			if !strings.ContainsAny(pattern, "*?[{") {
+				// A plain path names a file; watch its directory.
+				base = filepath.ToSlash(filepath.Dir(pattern))
+			}
+			if !slices.Contains(roots, base) {
+				roots = append(roots, base)
+			}
+		}
+	}
+	slices.Sort(roots)
+
+	var out []string
+	for _, root := range roots {
+		nested := slices.ContainsFunc(out, func(parent string) bool {
+			return parent == "." || strings.HasPrefix(root, parent+"/")
+		})
+		if !nested {
+			out = append(out, root)
+		}
+	}
+	return out
+}
+
+type ruleRunner struct {
+	rule    config.Rule
+	watcher RulesWatcher
+	dir     string
+	in      chan changes.File
+}
+
+func (r *ruleRunner) source() string {
+	return "rule:" + r.rule.Name
+}
+
+// loop collects the rule's changes during its debounce window and runs the
+// rule once they settle. Changes arriving while the rule runs are collected
+// for the next run instead of waiting for it.
+func (r *ruleRunner) loop(ctx context.Context, events chan<- dispatch.Event) {
+	var pending changes.Set
+	var fire <-chan time.Time
+	var running chan struct{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-r.in:
+			if pending.Detected.IsZero() {
+				pending.Detected = time.Now()
+			}
+			pending.Add(file.Path, file.Op)
+			fire = time.After(r.rule.DebounceDuration())
+		case <-fire:
+			fire = nil
+			if running != nil {
+				// Runs don't overlap; this one starts when the current ends.
+				continue
+			}
+			set := pending
+			set.Fired = time.Now()
+			pending = changes.Set{}
+			running = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				r.apply(ctx, events, set)
+			}(running)
+		case <-running:
+			running = nil
+			if fire == nil && len(pending.Files) > 0 {
+				fire = time.After(0)
+			}
+		}
+	}
+}
+
+func (r *ruleRunner) apply(ctx context.Context, events chan<- dispatch.Event, set changes.Set) {
+	name := r.rule.Name
+	fmt.Printf("[shadowfax] Rule %s: %s changed\n", name, strings.Join(set.Paths(), ", "))
+
+	if r.rule.Run != "" {
+		output, err := r.runCommand(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Printf("[shadowfax] Rule %s failed: %v\n", name, err)
+			emitError(ctx, events, r.source(), strings.TrimSpace(output+"\n"+err.Error()))
+			return
+		}
+		emitError(ctx, events, r.source(), "")
+	}
+
+	action, ok := ruleDispatchActions[r.rule.Action]
+	if !ok {
+		return
+	}
+	set.Reason = "rule " + name
+	if action == dispatch.ActionReloadCSS {
+		// The changed files aren't stylesheets; refresh all of them.
+		set.Files = nil
+	}
+	dispatch.Emit(ctx, events, dispatch.Event{Source: r.source(), Action: action, Changes: set})
+}
+
+// runCommand runs the rule's command, printing its output prefixed with
+// the rule name, and returns the tail of the output.
+func (r *ruleRunner) runCommand(ctx context.Context) (string, error) {
+	cmd := shellCommand(ctx, r.dir, r.rule.Run, r.watcher.Env)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	if r.watcher.AddProcess != nil {
+		r.watcher.AddProcess(cmd)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Printf("[%s] %s\n", r.rule.Name, line)
+		lines = append(lines, line)
+		if len(lines) > ruleOutputLines {
+			lines = lines[1:]
+		}
+	}
+	return strings.Join(lines, "\n"), cmd.Wait()
+}
@@ -0,0 +1,178 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/config"
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+)
+
+func TestRuleRoots(t *testing.T) {
+	got := ruleRoots([]config.Rule{
+		{Match: []string{"locales/**/*.json", "locales/en/*.json"}},
+		{Match: []string{"db/queries/*.sql", "config/app.yaml"}},
+	})
+	want := []string{"config", "db/queries", "locales"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ruleRoots = %v, want %v", got, want)
+	}
+
+	if got := ruleRoots([]config.Rule{{Match: []string{"**/*.sql", "db/*.sql"}}}); !slices.Equal(got, []string{"."}) {
+		t.Fatalf("expected the project root only, got %v", got)
+	}
+}
+
+// touchUntilEvent rewrites path until an event other than error-cleared
+// arrives, since the watcher starts asynchronously.
+func touchUntilEvent(t *testing.T, path string, events chan dispatch.Event) dispatch.Event {
+	t.Helper()
+	deadline := time.After(3 * time.Second)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if err := os.WriteFile(path, []byte(time.Now().String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-events:
+			if ev.Action != dispatch.ActionErrorCleared {
+				return ev
+			}
+		case <-tick.C:
+		case <-deadline:
+			t.Fatal("expected an event")
+		}
+	}
+}
+
+func TestRulesWatcherRunsCommandAndApplies(t *testing.T) {
+	tmp := chdirTemp(t)
+	if err := os.MkdirAll(filepath.Join(tmp, "locales", "en"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan dispatch.Event, 16)
+	w := RulesWatcher{Rules: []config.Rule{{
+		Name:     "i18n",
+		Match:    []string{"locales/**/*.json"},
+		Run:      "cat locales/en/*.json > bundle.txt",
+		Action:   config.RuleActionReload,
+		Debounce: "20ms",
+	}}}
+	go w.Run(ctx, events)
+
+	ev := touchUntilEvent(t, filepath.Join(tmp, "locales", "en", "app.json"), events)
+	if ev.Source != "rule:i18n" || ev.Action != dispatch.ActionReloadPage {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if !slices.Contains(ev.Paths(), "locales/en/app.json") {
+		t.Fatalf("expected changed file in event, got %v", ev.Paths())
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "bundle.txt")); err != nil {
+		t.Fatalf("expected rule command to run: %v", err)
+	}
+}
+
+func TestRulesWatcherReportsCommandFailure(t *testing.T) {
+	tmp := chdirTemp(t)
+	if err := os.MkdirAll(filepath.Join(tmp, "db", "queries"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan dispatch.Event, 16)
+	w := RulesWatcher{Rules: []config.Rule{{
+		Name:     "sqlc",
+		Match:    []string{"db/queries/*.sql"},
+		Run:      "echo 'queries.sql:3: syntax error'; exit 1",
+		Action:   config.RuleActionRebuild,
+		Debounce: "20ms",
+	}}}
+	go w.Run(ctx, events)
+
+	ev := touchUntilEvent(t, filepath.Join(tmp, "db", "queries", "users.sql"), events)
+	if ev.Action != dispatch.ActionError || ev.Source != "rule:sqlc" {
+		t.Fatalf("expected an error event, got %+v", ev)
+	}
+	if !strings.Contains(ev.Message, "queries.sql:3: syntax error") {
+		t.Fatalf("expected command output in error, got %q", ev.Message)
+	}
+}
+
+func TestRuleRunnerCollectsChangesWhileRunning(t *testing.T) {
+	tmp := chdirTemp(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan dispatch.Event, 16)
+	r := &ruleRunner{
+		rule: config.Rule{
+			Name:     "sqlc",
+			Match:    []string{"db/*.sql"},
+			Run:      "touch started; while [ ! -f release ]; do sleep 0.01; done",
+			Action:   config.RuleActionRebuild,
+			Debounce: "10ms",
+		},
+		dir: tmp,
+		in:  make(chan changes.File, 64),
+	}
+	go r.loop(ctx, events)
+
+	r.in <- changes.File{Path: "db/a.sql", Op: changes.OpWrite}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(tmp, "started")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rule command to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// More changes than the input buffer holds must not wait for the run.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := range 200 {
+			r.in <- changes.File{Path: fmt.Sprintf("db/q%d.sql", i%2), Op: changes.OpWrite}
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected changes to be collected while the rule runs")
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "release"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]string
+	for len(got) < 2 {
+		select {
+		case ev := <-events:
+			if ev.Action == dispatch.ActionRebuild {
+				got = append(got, ev.Paths())
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected two runs, got %v", got)
+		}
+	}
+	if !slices.Equal(got[0], []string{"db/a.sql"}) || !slices.Equal(got[1], []string{"db/q0.sql", "db/q1.sql"}) {
+		t.Fatalf("expected the changes made during the first run in the second, got %v", got)
+	}
+}
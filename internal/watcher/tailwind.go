@@ -8,46 +8,225 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
 )
 
 type TailwindConfig struct {
 	Verbose    bool
 	AddProcess func(*exec.Cmd)
+	// Env holds KEY=VALUE overrides for the Tailwind processes.
+	Env []string
+	// CLI is the Tailwind binary. Defaults to config.DefaultTailwindCLI.
+	CLI string
+	// Entries are built by one process each. Defaults to
+	// config.DefaultTailwindEntry.
+	Entries []config.TailwindEntry
+}
+
+// TailwindRebuild signals that the stylesheet of one entry was rebuilt.
+type TailwindRebuild struct {
+	Entry config.TailwindEntry
 }
 
 const tailwindRebuildDebounce = 250 * time.Millisecond
 
-func RunTailwindWatcher(ctx context.Context, cssRebuilt chan<- struct{}, cfg TailwindConfig) error {
+var (
+	tailwindRestartBackoff    = 500 * time.Millisecond
+	tailwindMaxRestartBackoff = 10 * time.Second
+	tailwindDetectTimeout     = 5 * time.Second
+)
+
+// tailwindProfile holds the flags and output patterns of one Tailwind CLI
+// major version.
+type tailwindProfile struct {
+	major     int
+	watchArgs []string
+	// keepStdinOpen is needed where the CLI stops watching once stdin
+	// closes.
+	keepStdinOpen bool
+	done          *regexp.Regexp
+}
+
+var (
+	tailwindV3 = tailwindProfile{
+		major:         3,
+		watchArgs:     []string{"--watch"},
+		keepStdinOpen: true,
+		done:          regexp.MustCompile(`^Done in [0-9.]+(µs|ms|s)\.?$`),
+	}
+	tailwindV4 = tailwindProfile{
+		major:     4,
+		watchArgs: []string{"--watch=always"},
+		done:      regexp.MustCompile(`Done in [0-9.]+(µs|ms|s)`),
+	}
+	// tailwindUnknown is used when the version can't be detected.
+	tailwindUnknown = tailwindProfile{watchArgs: []string{"--watch=always"}}
+)
+
+var tailwindVersionRegex = regexp.MustCompile(`tailwindcss v(\d+)\.\d+\.\d+`)
+
+func (p tailwindProfile) isDone(line string) bool {
+	if p.done == nil {
+		return isTailwindRebuildDoneLine(line)
+	}
+	return p.done.MatchString(strings.TrimSpace(line))
+}
+
+func (p tailwindProfile) args(entry config.TailwindEntry) []string {
+	args := []string{"-i", entry.Input, "-o", entry.Output}
+	args = append(args, p.watchArgs...)
+	if entry.Minify {
+		args = append(args, "--minify")
+	}
+	return args
+}
+
+// detectTailwind reads the CLI version from `--help`, which every Tailwind
+// release prints as "tailwindcss vX.Y.Z".
+func detectTailwind(ctx context.Context, cli, dir string, env []string) (tailwindProfile, string) {
+	ctx, cancel := context.WithTimeout(ctx, tailwindDetectTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cli, "--help")
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = config.MergeEnv(os.Environ(), env)
+	}
+	cmd.WaitDelay = 100 * time.Millisecond
+	out, _ := cmd.CombinedOutput()
+	return parseTailwindVersion(string(out))
+}
+
+func parseTailwindVersion(output string) (tailwindProfile, string) {
+	m := tailwindVersionRegex.FindStringSubmatch(output)
+	if m == nil {
+		return tailwindUnknown, ""
+	}
+	version := strings.TrimPrefix(m[0], "tailwindcss ")
+	switch major, _ := strconv.Atoi(m[1]); {
+	case major <= 3:
+		return tailwindV3, version
+	default:
+		return tailwindV4, version
+	}
+}
+
+// RunTailwindWatcher runs one supervised Tailwind process per entry. A
+// process that exits after building successfully is restarted with backoff;
+// one that fails before its first build stops all of them.
+func RunTailwindWatcher(ctx context.Context, cssRebuilt chan<- TailwindRebuild, cfg TailwindConfig) error {
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.CommandContext(ctx, wd+"/bin/tailwindcli",
-		"-i", "./css/base.css",
-		"-o", "./assets/css/style.css",
-		"--watch=always",
-	)
+	cli := cfg.CLI
+	if cli == "" {
+		cli = config.DefaultTailwindCLI
+	}
+	if !filepath.IsAbs(cli) {
+		cli = filepath.Join(wd, cli)
+	}
+	entries := cfg.Entries
+	if len(entries) == 0 {
+		entries = []config.TailwindEntry{config.DefaultTailwindEntry}
+	}
+
+	profile, version := detectTailwind(ctx, cli, wd, cfg.Env)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if version != "" {
+		fmt.Printf("[shadowfax] Tailwind CLI %s, building %d stylesheet(s)\n", version, len(entries))
+	} else if cfg.Verbose {
+		fmt.Println("[shadowfax] Could not detect the Tailwind CLI version, using v4 flags")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(entries))
+	for _, entry := range entries {
+		prefix := "[tailwind]"
+		if len(entries) > 1 {
+			prefix = "[tailwind:" + entry.Name + "]"
+		}
+		go func() {
+			errs <- superviseTailwind(ctx, cli, wd, profile, entry, prefix, cssRebuilt, cfg)
+		}()
+	}
+
+	var first error
+	for range entries {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
+
+func superviseTailwind(ctx context.Context, cli, dir string, profile tailwindProfile, entry config.TailwindEntry, prefix string, cssRebuilt chan<- TailwindRebuild, cfg TailwindConfig) error {
+	backoff := tailwindRestartBackoff
+	for {
+		built, err := runTailwindProcess(ctx, cli, dir, profile, entry, prefix, cssRebuilt, cfg)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !built {
+			if err != nil {
+				return fmt.Errorf("%s: %w", entry.Name, err)
+			}
+			return nil
+		}
+
+		fmt.Printf("[shadowfax] Tailwind (%s) exited (%v), restarting in %s\n", entry.Name, err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, tailwindMaxRestartBackoff)
+	}
+}
 
-	cmd.Dir = wd
+// runTailwindProcess runs the CLI for entry until it exits and reports
+// whether it completed at least one build.
+func runTailwindProcess(ctx context.Context, cli, dir string, profile tailwindProfile, entry config.TailwindEntry, prefix string, cssRebuilt chan<- TailwindRebuild, cfg TailwindConfig) (bool, error) {
+	cmd := exec.CommandContext(ctx, cli, profile.args(entry)...)
+	cmd.Dir = dir
+	if len(cfg.Env) > 0 {
+		cmd.Env = config.MergeEnv(os.Environ(), cfg.Env)
+	}
 
 	// Capture both stdout and stderr because Tailwind may print rebuild
 	// completion lines ("Done in ...") to stderr.
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return false, err
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		return false, err
+	}
+	var stdin io.WriteCloser
+	if profile.keepStdinOpen {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return false, err
+		}
+		defer stdin.Close()
 	}
 
 	if err := cmd.Start(); err != nil {
 		fmt.Println("Tailwind CLI not found. Run 'andurel sync' to download it.")
-		return err
+		return false, err
 	}
 
 	if cfg.AddProcess != nil {
@@ -56,8 +235,18 @@ func RunTailwindWatcher(ctx context.Context, cssRebuilt chan<- struct{}, cfg Tai
 
 	// Parse tailwind output to detect rebuilds.
 	var lastRebuildSignal atomic.Int64
-	go scanTailwindOutput(stdout, cfg.Verbose, cssRebuilt, &lastRebuildSignal)
-	go scanTailwindOutput(stderr, cfg.Verbose, cssRebuilt, &lastRebuildSignal)
+	var built atomic.Bool
+	onDone := func() {
+		built.Store(true)
+		if shouldEmitTailwindRebuild(&lastRebuildSignal, tailwindRebuildDebounce) {
+			select {
+			case cssRebuilt <- TailwindRebuild{Entry: entry}:
+			default:
+			}
+		}
+	}
+	go scanTailwindOutput(stdout, prefix, cfg.Verbose, profile, onDone)
+	go scanTailwindOutput(stderr, prefix, cfg.Verbose, profile, onDone)
 
 	done := make(chan error, 1)
 	go func() {
@@ -68,34 +257,26 @@ func RunTailwindWatcher(ctx context.Context, cssRebuilt chan<- struct{}, cfg Tai
 	case <-ctx.Done():
 		if cmd.Process != nil {
 			if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
-				return err
+				return built.Load(), err
 			}
 		}
-		if err := <-done; err != nil && ctx.Err() == nil {
-			return err
-		}
-		return nil
+		<-done
+		return built.Load(), nil
 	case err := <-done:
-		if err != nil && ctx.Err() != nil {
-			return nil
-		}
-		return err
+		return built.Load(), err
 	}
 }
 
-func scanTailwindOutput(reader io.Reader, verbose bool, cssRebuilt chan<- struct{}, lastRebuildSignal *atomic.Int64) {
+func scanTailwindOutput(reader io.Reader, prefix string, verbose bool, profile tailwindProfile, onDone func()) {
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if verbose {
-			fmt.Printf("[tailwind] %s\n", line)
+			fmt.Printf("%s %s\n", prefix, line)
 		}
 
-		if isTailwindRebuildDoneLine(line) && shouldEmitTailwindRebuild(lastRebuildSignal, tailwindRebuildDebounce) {
-			select {
-			case cssRebuilt <- struct{}{}:
-			default:
-			}
+		if profile.isDone(line) {
+			onDone()
 		}
 	}
 }
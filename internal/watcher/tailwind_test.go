@@ -4,9 +4,12 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
 )
 
 func TestIsTailwindRebuildDoneLine(t *testing.T) {
@@ -83,7 +86,7 @@ done
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- RunTailwindWatcher(ctx, make(chan struct{}, 1), TailwindConfig{})
+		errCh <- RunTailwindWatcher(ctx, make(chan TailwindRebuild, 1), TailwindConfig{})
 	}()
 
 	time.Sleep(50 * time.Millisecond)
@@ -118,12 +121,102 @@ exit 7
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	err = RunTailwindWatcher(ctx, make(chan struct{}, 1), TailwindConfig{})
+	err = RunTailwindWatcher(ctx, make(chan TailwindRebuild, 1), TailwindConfig{})
 	if err == nil {
 		t.Fatal("expected process error, got nil")
 	}
 }
 
+func TestParseTailwindVersion(t *testing.T) {
+	tests := []struct {
+		output  string
+		major   int
+		version string
+	}{
+		{output: "tailwindcss v3.4.1\n\nUsage:", major: 3, version: "v3.4.1"},
+		{output: "≈ tailwindcss v4.0.0\n\nUsage:", major: 4, version: "v4.0.0"},
+		{output: "command not found", major: 0, version: ""},
+	}
+
+	for _, tt := range tests {
+		profile, version := parseTailwindVersion(tt.output)
+		if profile.major != tt.major || version != tt.version {
+			t.Errorf("parseTailwindVersion(%q) = v%d %q, want v%d %q", tt.output, profile.major, version, tt.major, tt.version)
+		}
+	}
+}
+
+func TestTailwindProfiles(t *testing.T) {
+	entry := config.TailwindEntry{Input: "css/admin.css", Output: "assets/css/admin.css", Minify: true}
+
+	v3 := tailwindV3.args(entry)
+	if !slices.Contains(v3, "--watch") || !slices.Contains(v3, "--minify") {
+		t.Fatalf("unexpected v3 args: %v", v3)
+	}
+	if v4 := tailwindV4.args(entry); !slices.Contains(v4, "--watch=always") {
+		t.Fatalf("unexpected v4 args: %v", v4)
+	}
+
+	if !tailwindV3.isDone("Done in 143ms.") || tailwindV3.isDone("Rebuilding... Done in soon") {
+		t.Fatal("v3 done pattern mismatch")
+	}
+	if !tailwindV4.isDone("Done in 44µs") || tailwindV4.isDone("Rebuilding...") {
+		t.Fatal("v4 done pattern mismatch")
+	}
+}
+
+func TestRunTailwindWatcherSignalsEachEntry(t *testing.T) {
+	tmp := t.TempDir()
+	// Reports v3 and, like the v3 CLI, only keeps watching while stdin is
+	// open.
+	createTailwindScript(t, tmp, `#!/usr/bin/env sh
+if [ "$1" = "--help" ]; then
+  echo "tailwindcss v3.4.1"
+  exit 0
+fi
+echo "Done in 5ms."
+cat
+`)
+
+	oldWD, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(oldWD) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rebuilt := make(chan TailwindRebuild, 2)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- RunTailwindWatcher(ctx, rebuilt, TailwindConfig{Entries: []config.TailwindEntry{
+			{Name: "style", Input: "css/base.css", Output: "assets/css/style.css"},
+			{Name: "admin", Input: "css/admin.css", Output: "assets/css/admin.css"},
+		}})
+	}()
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case r := <-rebuilt:
+			seen[r.Entry.Name] = true
+		case err := <-errCh:
+			t.Fatalf("watcher exited early: %v", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected a rebuild per entry, got %v", seen)
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected nil on cancel, got %v", err)
+	}
+}
+
 func createTailwindScript(t *testing.T, root, content string) {
 	t.Helper()
 
@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
 )
 
 type TemplChange int8
@@ -17,8 +19,41 @@ const (
 	TemplChangeNone               TemplChange = iota
 	TemplChangeNeedsRestart                   // Full server restart needed (e.g., _templ.go changed)
 	TemplChangeNeedsBrowserReload             // Just browser reload needed (e.g., template content changed)
+	TemplChangeErrors                         // The generation errors changed; Errors holds the current ones
 )
 
+// TemplEvent is the result of one batch of templ generation.
+type TemplEvent struct {
+	Change TemplChange
+	// Files lists the generated _templ.go files. Only known in-process.
+	Files []string
+	// Errors lists every current generation error, empty once they are
+	// all fixed. Only sent in-process.
+	Errors []TemplError
+}
+
+// TemplError is a generation error in a .templ file. Line and Col are
+// 1-based and zero when templ doesn't report a position.
+type TemplError struct {
+	File    string
+	Line    int
+	Col     int
+	Message string
+}
+
+func (e TemplError) Error() string {
+	switch {
+	case e.Line == 0:
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	case e.Col == 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Message)
+	}
+}
+
+func (e TemplError) String() string { return e.Error() }
+
 var (
 	bytesPrefixWarning      = []byte(`(!)`)
 	bytesPrefixErr          = []byte(`(✗)`)
@@ -33,10 +68,21 @@ var templShutdownTimeout = 2 * time.Second
 type TemplWatcherConfig struct {
 	Verbose     bool
 	AddProcess  func(*exec.Cmd)
+	// OnTemplErr is called with the current error text, or "" once the
+	// errors are cleared.
 	OnTemplErr  func(msg string)
+	// Env holds KEY=VALUE overrides for the templ process.
+	Env []string
+	// InProcess drives templ's generator through its Go API instead of
+	// running bin/templ and scraping its log output. Env is ignored.
+	InProcess bool
 }
 
-func RunTemplWatcher(ctx context.Context, templChange chan<- TemplChange, cfg TemplWatcherConfig) error {
+func RunTemplWatcher(ctx context.Context, templChange chan<- TemplEvent, cfg TemplWatcherConfig) error {
+	if cfg.InProcess {
+		return runTemplInProcess(ctx, templChange, cfg)
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -49,6 +95,9 @@ func RunTemplWatcher(ctx context.Context, templChange chan<- TemplChange, cfg Te
 		// Only watch .templ files - the Go watcher handles .go files
 		"--watch-pattern", `(.+\.templ$)`,
 	)
+	if len(cfg.Env) > 0 {
+		cmd.Env = config.MergeEnv(os.Environ(), cfg.Env)
+	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
@@ -96,13 +145,13 @@ func RunTemplWatcher(ctx context.Context, templChange chan<- TemplChange, cfg Te
 				case bytes.Contains(after, bytesNeedsRestart):
 					fmt.Println("[shadowfax] templ: needs restart (Go code changed)")
 					select {
-					case templChange <- TemplChangeNeedsRestart:
+					case templChange <- TemplEvent{Change: TemplChangeNeedsRestart}:
 					default:
 					}
 				case bytes.Contains(after, bytesNeedsBrowserReload):
 					fmt.Println("[shadowfax] templ: needs browser reload (template content changed)")
 					select {
-					case templChange <- TemplChangeNeedsBrowserReload:
+					case templChange <- TemplEvent{Change: TemplChangeNeedsBrowserReload}:
 					default:
 					}
 				}
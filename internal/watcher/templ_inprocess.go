@@ -0,0 +1,334 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/scanner"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-h/parse"
+	"github.com/a-h/templ"
+	"github.com/a-h/templ/cmd/templ/generatecmd"
+	"github.com/a-h/templ/cmd/templ/generatecmd/modcheck"
+	templwatcher "github.com/a-h/templ/cmd/templ/generatecmd/watcher"
+	"github.com/a-h/templ/generator"
+	"github.com/fsnotify/fsnotify"
+)
+
+// TemplGeneratorVersion is the version of the templ generator linked into
+// shadowfax and used by the in-process mode.
+func TemplGeneratorVersion() string {
+	return templ.Version()
+}
+
+// Only watch .templ files - the Go watcher handles .go files.
+var templWatchPattern = regexp.MustCompile(`(.+\.templ$)`)
+
+// templBatchDelay groups the results of files generated together, as
+// templ generate --watch does.
+var templBatchDelay = 100 * time.Millisecond
+
+func runTemplInProcess(ctx context.Context, templChange chan<- TemplEvent, cfg TemplWatcherConfig) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[shadowfax] Starting templ generate --watch (in-process, %s)\n", templ.Version())
+	err = generateTempl(ctx, wd, true, newTemplEvents(ctx, templChange, cfg))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// generateTempl generates every template under dir and, with watch, keeps
+// regenerating changed ones until ctx is done. It drives templ's event
+// handler directly so results and errors arrive as values.
+func generateTempl(ctx context.Context, dir string, watch bool, events *templEvents) error {
+	if err := modcheck.Check(dir); err != nil {
+		fmt.Printf("[shadowfax] templ warning: %v\n", err)
+	}
+
+	log := slog.New(&templLogHandler{verbose: events.cfg.Verbose})
+	fseh := generatecmd.NewFSEventHandler(log, dir, watch,
+		[]generator.GenerateOpt{generator.WithVersion(templ.Version())},
+		false, false, generatecmd.FileWriter, false)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fsEvents := make(chan fsnotify.Event)
+	watchErrs := make(chan error)
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(fsEvents)
+		if err := templwatcher.WalkFiles(ctx, dir, templWatchPattern, nil, fsEvents); err != nil {
+			walkErr <- fmt.Errorf("walking templ files: %w", err)
+			return
+		}
+		if !watch {
+			return
+		}
+		rw, err := templwatcher.Recursive(ctx, templWatchPattern, nil, fsEvents, watchErrs)
+		if err != nil {
+			walkErr <- fmt.Errorf("watching templ files: %w", err)
+			return
+		}
+		defer rw.Close()
+		if err := rw.Add(dir); err != nil {
+			walkErr <- fmt.Errorf("watching templ files: %w", err)
+			return
+		}
+		<-ctx.Done()
+	}()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for {
+		select {
+		case err := <-watchErrs:
+			if events.cfg.Verbose {
+				fmt.Printf("[shadowfax] templ watcher error: %v\n", err)
+			}
+		case ev, ok := <-fsEvents:
+			if !ok {
+				wg.Wait()
+				events.flush()
+				select {
+				case err := <-walkErr:
+					return err
+				default:
+				}
+				return events.err()
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				events.removed(ev.Name)
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				result, err := fseh.HandleEvent(ctx, ev)
+				if ctx.Err() == nil {
+					events.generated(ev.Name, result, err)
+				}
+			}()
+		}
+	}
+}
+
+// templEvents turns the results of templ's event handler into batched
+// TemplEvents.
+type templEvents struct {
+	ctx context.Context
+	out chan<- TemplEvent
+	cfg TemplWatcherConfig
+
+	mu            sync.Mutex
+	timer         *time.Timer
+	pending       TemplEvent
+	errors        map[string][]TemplError
+	errorsChanged bool
+}
+
+func newTemplEvents(ctx context.Context, out chan<- TemplEvent, cfg TemplWatcherConfig) *templEvents {
+	return &templEvents{ctx: ctx, out: out, cfg: cfg, errors: make(map[string][]TemplError)}
+}
+
+// generated records the result of generating file.
+func (e *templEvents) generated(file string, result generatecmd.GenerateResult, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err != nil {
+		errs := templErrors(file, err)
+		for _, te := range errs {
+			fmt.Printf("[shadowfax] templ error: %s\n", te)
+		}
+		e.errors[file] = errs
+		e.errorsChanged = true
+		e.scheduleLocked()
+		return
+	}
+	if _, ok := e.errors[file]; ok {
+		delete(e.errors, file)
+		e.errorsChanged = true
+		if len(e.errors) == 0 {
+			fmt.Println("[shadowfax] templ error cleared")
+		} else {
+			fmt.Printf("[shadowfax] templ error cleared in %s (%d remaining)\n", file, len(e.errors))
+		}
+	}
+
+	switch {
+	case result.TemplFileGoUpdated || result.WatchedFileUpdated:
+		e.pending.Change = TemplChangeNeedsRestart
+	case result.TemplFileTextUpdated && e.pending.Change == TemplChangeNone:
+		e.pending.Change = TemplChangeNeedsBrowserReload
+	}
+	if result.TemplFileGoUpdated || result.TemplFileTextUpdated {
+		goFile := strings.TrimSuffix(file, ".templ") + "_templ.go"
+		if !slices.Contains(e.pending.Files, goFile) {
+			e.pending.Files = append(e.pending.Files, goFile)
+		}
+	}
+	e.scheduleLocked()
+}
+
+// removed drops the errors of a deleted template.
+func (e *templEvents) removed(file string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.errors[file]; ok {
+		delete(e.errors, file)
+		e.errorsChanged = true
+		e.scheduleLocked()
+	}
+}
+
+func (e *templEvents) scheduleLocked() {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.timer = time.AfterFunc(templBatchDelay, e.flush)
+}
+
+// flush sends the pending change and, if they changed, the current errors.
+func (e *templEvents) flush() {
+	e.mu.Lock()
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	ev := e.pending
+	e.pending = TemplEvent{}
+	var errEv *TemplEvent
+	if e.errorsChanged {
+		e.errorsChanged = false
+		errEv = &TemplEvent{Change: TemplChangeErrors, Errors: e.currentErrorsLocked()}
+	}
+	e.mu.Unlock()
+
+	if errEv != nil {
+		e.send(*errEv)
+	}
+	switch ev.Change {
+	case TemplChangeNeedsRestart:
+		fmt.Println("[shadowfax] templ: needs restart (Go code changed)")
+		e.send(ev)
+	case TemplChangeNeedsBrowserReload:
+		fmt.Println("[shadowfax] templ: needs browser reload (template content changed)")
+		e.send(ev)
+	}
+}
+
+func (e *templEvents) send(ev TemplEvent) {
+	if e.out == nil {
+		return
+	}
+	select {
+	case e.out <- ev:
+	case <-e.ctx.Done():
+	}
+}
+
+func (e *templEvents) currentErrorsLocked() []TemplError {
+	var errs []TemplError
+	for _, fileErrs := range e.errors {
+		errs = append(errs, fileErrs...)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].File != errs[j].File {
+			return errs[i].File < errs[j].File
+		}
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Col < errs[j].Col
+	})
+	return errs
+}
+
+// err returns the current errors as one error, or nil.
+func (e *templEvents) err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var errs []error
+	for _, te := range e.currentErrorsLocked() {
+		errs = append(errs, te)
+	}
+	return errors.Join(errs...)
+}
+
+// templErrors extracts the positions of a generation error of file. Parse
+// errors carry one position, formatting errors of the generated Go code a
+// list of positions mapped back to the template.
+func templErrors(file string, err error) []TemplError {
+	var parseErr parse.ParseError
+	if errors.As(err, &parseErr) {
+		return []TemplError{{File: file, Line: parseErr.Pos.Line + 1, Col: parseErr.Pos.Col + 1, Message: parseErr.Msg}}
+	}
+	var list scanner.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		errs := make([]TemplError, len(list))
+		for i, e := range list {
+			errs[i] = TemplError{File: file, Line: e.Pos.Line, Col: e.Pos.Column, Message: e.Msg}
+		}
+		return errs
+	}
+	return []TemplError{{File: file, Message: err.Error()}}
+}
+
+// templLogHandler prints the log of templ's event handler: warnings, such
+// as template diagnostics, always and everything else when verbose.
+type templLogHandler struct {
+	verbose bool
+	attrs   []slog.Attr
+}
+
+func (h *templLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.verbose || level >= slog.LevelWarn
+}
+
+func (h *templLogHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	for _, a := range h.attrs {
+		fmt.Fprintf(&b, " %s", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s", a)
+		return true
+	})
+	if r.Level >= slog.LevelWarn {
+		fmt.Printf("[shadowfax] templ warning: %s%s\n", r.Message, b.String())
+	} else {
+		fmt.Printf("[templ] %s%s\n", r.Message, b.String())
+	}
+	return nil
+}
+
+func (h *templLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &templLogHandler{verbose: h.verbose, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *templLogHandler) WithGroup(string) slog.Handler { return h }
+
+// GenerateTempl runs a one-shot templ generate in-process.
+func GenerateTempl(ctx context.Context, verbose bool) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return generateTempl(ctx, wd, false, newTemplEvents(ctx, nil, TemplWatcherConfig{Verbose: verbose}))
+}
@@ -0,0 +1,135 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/parse"
+	"github.com/a-h/templ/cmd/templ/generatecmd"
+)
+
+func TestTemplEventsFromResults(t *testing.T) {
+	out := make(chan TemplEvent, 4)
+	events := newTemplEvents(context.Background(), out, TemplWatcherConfig{})
+
+	events.generated("/app/views/home.templ", generatecmd.GenerateResult{TemplFileTextUpdated: true}, nil)
+	events.generated("/app/views/nav.templ", generatecmd.GenerateResult{TemplFileGoUpdated: true}, nil)
+	ev := <-out
+	if ev.Change != TemplChangeNeedsRestart {
+		t.Fatalf("expected restart, got %v", ev.Change)
+	}
+	if strings.Join(ev.Files, ",") != "/app/views/home_templ.go,/app/views/nav_templ.go" {
+		t.Fatalf("unexpected generated files: %v", ev.Files)
+	}
+
+	events.generated("/app/views/home.templ", generatecmd.GenerateResult{TemplFileTextUpdated: true}, nil)
+	if ev := <-out; ev.Change != TemplChangeNeedsBrowserReload {
+		t.Fatalf("expected browser reload, got %+v", ev)
+	}
+
+	parseErr := fmt.Errorf("failed to generate code for %q: %w", "/app/views/home.templ", parse.Error("unexpected EOF", parse.Position{Line: 2, Col: 4}))
+	events.generated("/app/views/home.templ", generatecmd.GenerateResult{}, parseErr)
+	events.generated("/app/views/nav.templ", generatecmd.GenerateResult{}, errors.New("bad token"))
+	ev = <-out
+	want := []TemplError{
+		{File: "/app/views/home.templ", Line: 3, Col: 5, Message: "unexpected EOF"},
+		{File: "/app/views/nav.templ", Message: "bad token"},
+	}
+	if ev.Change != TemplChangeErrors || !slices.Equal(ev.Errors, want) {
+		t.Fatalf("expected both errors with positions, got %+v", ev)
+	}
+
+	events.generated("/app/views/home.templ", generatecmd.GenerateResult{}, nil)
+	if ev := <-out; ev.Change != TemplChangeErrors || !slices.Equal(ev.Errors, want[1:]) {
+		t.Fatalf("expected only the nav.templ error to remain, got %+v", ev)
+	}
+
+	events.removed("/app/views/nav.templ")
+	if ev := <-out; ev.Change != TemplChangeErrors || len(ev.Errors) != 0 {
+		t.Fatalf("expected errors to be cleared, got %+v", ev)
+	}
+}
+
+func TestGenerateTemplReportsErrorPositions(t *testing.T) {
+	tmp := t.TempDir()
+	t.Chdir(tmp)
+	writeFile(t, filepath.Join(tmp, "go.mod"), "module example.com/app\n\ngo 1.25\n\nrequire github.com/a-h/templ "+TemplGeneratorVersion()+"\n")
+	file := filepath.Join(tmp, "views", "home.templ")
+	writeFile(t, file, "package views\n\ntempl Home() {\n\t<h1>Hello</h2>\n}\n")
+
+	err := GenerateTempl(context.Background(), false)
+	var te TemplError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected a TemplError, got %v", err)
+	}
+	if te.File != file || te.Line != 4 || te.Col == 0 {
+		t.Fatalf("expected a position in home.templ line 4, got %+v", te)
+	}
+}
+
+func TestRunTemplWatcherInProcessGeneratesCode(t *testing.T) {
+	tmp := t.TempDir()
+	writeFile(t, filepath.Join(tmp, "go.mod"), "module example.com/app\n\ngo 1.25\n\nrequire github.com/a-h/templ "+TemplGeneratorVersion()+"\n")
+	writeFile(t, filepath.Join(tmp, "views", "home.templ"), "package views\n\ntempl Home() {\n\t<h1>Hello</h1>\n}\n")
+
+	oldWD, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(oldWD) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := make(chan TemplEvent, 4)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- RunTemplWatcher(ctx, out, TemplWatcherConfig{InProcess: true})
+	}()
+
+	generated := filepath.Join(tmp, "views", "home_templ.go")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(generated); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("initial generation did not write home_templ.go")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	writeFile(t, filepath.Join(tmp, "views", "home.templ"), "package views\n\ntempl Home(name string) {\n\t<h1>Hello { name }</h1>\n}\n")
+
+	select {
+	case ev := <-out:
+		if ev.Change != TemplChangeNeedsRestart {
+			t.Fatalf("expected restart for a signature change, got %+v", ev)
+		}
+		if strings.Join(ev.Files, ",") != generated {
+			t.Fatalf("unexpected generated files: %v", ev.Files)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no templ event after editing the template")
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("expected nil on cancel, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunTemplWatcher did not return after cancel")
+	}
+}
@@ -36,7 +36,7 @@ done
 	errCh := make(chan error, 1)
 	start := time.Now()
 	go func() {
-		errCh <- RunTemplWatcher(ctx, make(chan TemplChange, 1), TemplWatcherConfig{})
+		errCh <- RunTemplWatcher(ctx, make(chan TemplEvent, 1), TemplWatcherConfig{})
 	}()
 
 	time.Sleep(50 * time.Millisecond)
@@ -74,7 +74,7 @@ exit 7
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	err = RunTemplWatcher(ctx, make(chan TemplChange, 1), TemplWatcherConfig{})
+	err = RunTemplWatcher(ctx, make(chan TemplEvent, 1), TemplWatcherConfig{})
 	if err == nil {
 		t.Fatal("expected process error, got nil")
 	}
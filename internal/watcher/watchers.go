@@ -0,0 +1,218 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/changes"
+	"github.com/mbvlabs/shadowfax/internal/config"
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+)
+
+// Event sources of the built-in watchers.
+const (
+	SourceGo       = "go"
+	SourceTempl    = "templ"
+	SourceTailwind = "tailwind"
+	SourceAssets   = "assets"
+)
+
+// GoWatcher asks for a rebuild whenever Go build inputs change.
+type GoWatcher struct {
+	Config GoWatcherConfig
+}
+
+func (GoWatcher) Name() string { return SourceGo }
+
+func (w GoWatcher) Run(ctx context.Context, events chan<- dispatch.Event) error {
+	sets := make(chan changes.Set, 1)
+	done := make(chan error, 1)
+	go func() { done <- RunGoWatcher(ctx, sets, w.Config) }()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case set := <-sets:
+			dispatch.Emit(ctx, events, dispatch.Event{Source: SourceGo, Action: dispatch.ActionRebuild, Changes: set})
+		}
+	}
+}
+
+// TemplWatcher reports templ generation: template text changes reload the
+// page, generated Go code changes restart the app.
+type TemplWatcher struct {
+	Config TemplWatcherConfig
+	// Regenerate is set when template text is compiled into the binary
+	// (TEMPL_DEV_MODE disabled). Text changes then regenerate the Go code
+	// and rebuild instead of reloading the page.
+	Regenerate func(ctx context.Context) error
+}
+
+func (TemplWatcher) Name() string { return SourceTempl }
+
+func (w TemplWatcher) Run(ctx context.Context, events chan<- dispatch.Event) error {
+	cfg := w.Config
+	onErr := cfg.OnTemplErr
+	cfg.OnTemplErr = func(msg string) {
+		if onErr != nil {
+			onErr(msg)
+		}
+		emitError(ctx, events, SourceTempl, msg)
+	}
+
+	templChange := make(chan TemplEvent, 1)
+	done := make(chan error, 1)
+	go func() { done <- RunTemplWatcher(ctx, templChange, cfg) }()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case ev := <-templChange:
+			now := time.Now()
+			set := changes.Set{Detected: now, Fired: now}
+			switch ev.Change {
+			case TemplChangeErrors:
+				msgs := make([]string, len(ev.Errors))
+				for i, te := range ev.Errors {
+					msgs[i] = te.Error()
+				}
+				cfg.OnTemplErr(strings.Join(msgs, "\n"))
+			case TemplChangeNeedsBrowserReload:
+				if w.Regenerate == nil {
+					set.Reason = "template changed"
+					dispatch.Emit(ctx, events, dispatch.Event{Source: SourceTempl, Action: dispatch.ActionReloadPage, Changes: set})
+					continue
+				}
+				fmt.Println("[shadowfax] Template changed, regenerating (TEMPL_DEV_MODE disabled)")
+				if err := w.Regenerate(ctx); err != nil {
+					fmt.Printf("[shadowfax] templ generate failed: %v\n", err)
+					continue
+				}
+				set.Reason = "templ regenerated Go code"
+				dispatch.Emit(ctx, events, dispatch.Event{Source: SourceTempl, Action: dispatch.ActionRebuild, Changes: set})
+			case TemplChangeNeedsRestart:
+				for _, file := range ev.Files {
+					set.Add(file, changes.OpWrite)
+				}
+				if len(set.Files) == 0 {
+					set.Reason = "templ output changed"
+				}
+				dispatch.Emit(ctx, events, dispatch.Event{Source: SourceTempl, Action: dispatch.ActionRestart, Changes: set})
+			}
+		}
+	}
+}
+
+// TailwindWatcher reports rebuilt stylesheets. It follows the other
+// watchers, since templates and scripts may use new classes.
+type TailwindWatcher struct {
+	Config TailwindConfig
+}
+
+func (TailwindWatcher) Name() string { return SourceTailwind }
+
+func (w TailwindWatcher) Run(ctx context.Context, events chan<- dispatch.Event) error {
+	rebuilt := make(chan TailwindRebuild, len(w.entries()))
+	done := make(chan error, 1)
+	go func() { done <- RunTailwindWatcher(ctx, rebuilt, w.Config) }()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case r := <-rebuilt:
+			now := time.Now()
+			set := changes.Set{Detected: now, Fired: now, Reason: r.Entry.Name}
+			set.Add(r.Entry.Output, changes.OpWrite)
+			dispatch.Emit(ctx, events, dispatch.Event{Source: SourceTailwind, Action: dispatch.ActionReloadCSS, Changes: set})
+		}
+	}
+}
+
+// Follow touches every entry's input so each Tailwind process rescans the
+// project.
+func (w TailwindWatcher) Follow(ev dispatch.Event) bool {
+	fmt.Printf("[shadowfax] %s changed, triggering CSS rebuild\n", ev.Source)
+	var errs []error
+	for _, entry := range w.entries() {
+		if err := touchFile(entry.Input); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		fmt.Printf("[shadowfax] Warning: could not touch CSS file: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func (w TailwindWatcher) entries() []config.TailwindEntry {
+	if len(w.Config.Entries) == 0 {
+		return []config.TailwindEntry{config.DefaultTailwindEntry}
+	}
+	return w.Config.Entries
+}
+
+// AssetsWatcher reports asset builds as page reloads, or as script reloads
+// with config.AssetsReloadJS.
+type AssetsWatcher struct {
+	Config AssetsConfig
+	Reload string
+}
+
+func (AssetsWatcher) Name() string { return SourceAssets }
+
+func (w AssetsWatcher) Run(ctx context.Context, events chan<- dispatch.Event) error {
+	cfg := w.Config
+	onErr := cfg.OnError
+	cfg.OnError = func(msg string) {
+		if onErr != nil {
+			onErr(msg)
+		}
+		emitError(ctx, events, SourceAssets, msg)
+	}
+
+	action := dispatch.ActionReloadPage
+	if w.Reload == config.AssetsReloadJS {
+		action = dispatch.ActionReloadJS
+	}
+
+	built := make(chan AssetsBuild, 1)
+	done := make(chan error, 1)
+	go func() { done <- RunAssetsWatcher(ctx, built, cfg) }()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case b := <-built:
+			now := time.Now()
+			set := changes.Set{Detected: now, Fired: now, Reason: "assets built"}
+			for _, file := range b.Files {
+				set.Add(file, changes.OpWrite)
+			}
+			dispatch.Emit(ctx, events, dispatch.Event{Source: SourceAssets, Action: action, Changes: set})
+		}
+	}
+}
+
+// emitError reports msg as the source's error, or clears it when empty.
+func emitError(ctx context.Context, events chan<- dispatch.Event, source, msg string) {
+	ev := dispatch.Event{Source: source, Action: dispatch.ActionError, Message: msg}
+	if msg == "" {
+		ev.Action = dispatch.ActionErrorCleared
+	}
+	dispatch.Emit(ctx, events, ev)
+}
+
+// touchFile updates the modification time of a file to trigger file watchers.
+func touchFile(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
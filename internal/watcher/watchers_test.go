@@ -0,0 +1,72 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mbvlabs/shadowfax/internal/config"
+	"github.com/mbvlabs/shadowfax/internal/dispatch"
+)
+
+func TestTouchFileUpdatesMtime(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "touch-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	before, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure clock advances
+	time.Sleep(10 * time.Millisecond)
+
+	if err := touchFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !after.ModTime().After(before.ModTime()) {
+		t.Error("touchFile should update the file's modification time")
+	}
+}
+
+func TestTouchFileErrorOnMissingFile(t *testing.T) {
+	err := touchFile(t.TempDir() + "/nonexistent")
+	if err == nil {
+		t.Error("touchFile should return an error for a nonexistent file")
+	}
+}
+
+func TestTailwindWatcherFollowTouchesInputs(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "base.css")
+	if err := os.WriteFile(input, []byte("@import 'tailwindcss';\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(input, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	w := TailwindWatcher{Config: TailwindConfig{Entries: []config.TailwindEntry{{Name: "style", Input: input, Output: "out.css"}}}}
+	if !w.Follow(dispatch.Event{Source: SourceTempl, Action: dispatch.ActionReloadPage}) {
+		t.Fatal("expected Follow to report a pending CSS rebuild")
+	}
+	if info, err := os.Stat(input); err != nil || !info.ModTime().After(old) {
+		t.Fatalf("expected input to be touched: %v", err)
+	}
+
+	w.Config.Entries[0].Input = filepath.Join(dir, "missing.css")
+	if w.Follow(dispatch.Event{Source: SourceTempl, Action: dispatch.ActionReloadPage}) {
+		t.Fatal("expected Follow to fail when an input is missing")
+	}
+}